@@ -0,0 +1,8 @@
+//go:build debug
+// +build debug
+
+package main
+
+// Built with `-tags debug`: enables extra internal consistency checks in the
+// MMU which are too slow to leave on for fuzzing
+const MMU_DEBUG = true
@@ -0,0 +1,43 @@
+//go:build debug
+// +build debug
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Call `f` and return the message it panicked with, or "" if it didn't
+func panic_message(f func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, _ = r.(string)
+		}
+	}()
+	f()
+	return ""
+}
+
+// A bad index into guest memory names the operation which made it
+func TestDebugBadIndex(t *testing.T) {
+	m := newMmu(0x1000)
+
+	msg := panic_message(func() { m.at(0x1000, "write_from") })
+	if !strings.HasPrefix(msg, "MMU bug in write_from") || !strings.Contains(msg, "0x1000") {
+		t.Errorf("at past the end panicked with %q", msg)
+	}
+	msg = panic_message(func() { m.span(0xff0, 0x1010, "mem_copy") })
+	if !strings.HasPrefix(msg, "MMU bug in mem_copy") {
+		t.Errorf("span past the end panicked with %q", msg)
+	}
+	msg = panic_message(func() { m.span(0x20, 0x10, "mem_set") })
+	if !strings.HasPrefix(msg, "MMU bug in mem_set") {
+		t.Errorf("reversed span panicked with %q", msg)
+	}
+
+	// In range indices are fine
+	if msg := panic_message(func() { m.at(0xfff, "read_into"); m.span(0, 0x1000, "reset") }); msg != "" {
+		t.Errorf("in range access panicked with %q", msg)
+	}
+}
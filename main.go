@@ -2,8 +2,16 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
 )
 
 // Constants for permission bits
@@ -18,17 +26,378 @@ const PERM_RAW uint8 = 1 << 3
 // Sweet spot is 128-4096 bytes
 const DIRTY_BLOCK_SIZE uint = 4096
 
+// Page size used when reporting which page a fault falls in
+const PAGE_SIZE uint = 4096
+
+// How far either side of an unmapped faulting byte to look for mapped memory
+// when reporting what the fault was near. Anything further is a wild pointer
+const NEAREST_MAPPED_WINDOW uint = PAGE_SIZE
+
+// Default size of the guest stack set up by `setup_stack`
+const DEFAULT_STACK_SIZE uint = 1024 * 1024
+
+// Size of the no-permission guard region placed below the guest stack
+const STACK_GUARD_SIZE uint = 4096
+
+// Size of the no-permission red zones placed either side of a buffer by
+// `allocate_redzoned`
+const REDZONE_SIZE uint = 64
+
+// Errors returned when a guest memory access fails its checks
+var (
+	ErrWriteOOB      = errors.New("Operation would write OOB of guest address space")
+	ErrWriteDenied   = errors.New("Write permission denied")
+	ErrReadOOB       = errors.New("Operation would read OOB of guest address space")
+	ErrReadDenied    = errors.New("Read permission denied")
+	ErrNullDeref     = errors.New("Access to the null guard page")
+	ErrAllocOOM      = errors.New("allocation would go beyond the guest address space")
+	ErrAllocTooLarge = errors.New("allocation is larger than the per-allocation cap")
+	ErrGrowAfterFork = errors.New("can't grow an MMU which has been forked or is a fork")
+	ErrNotParent     = errors.New("can only reset an MMU to the MMU it was forked from")
+	ErrCodeWrite     = errors.New("Write to executable memory")
+)
+
+// Classification of a guest fault, shared by everything which reports one
+type FaultKind uint8
+
+const (
+	// Not a fault
+	FAULT_NONE FaultKind = iota
+
+	// Read past the end of the guest address space
+	FAULT_READ_OOB
+
+	// Write past the end of the guest address space
+	FAULT_WRITE_OOB
+
+	// Read of allocated memory which was never written (PERM_RAW but no PERM_READ)
+	FAULT_UNINIT_READ
+
+	// Access to memory without the required permission
+	FAULT_PERM_DENIED
+
+	// Access to memory which has been freed
+	FAULT_USE_AFTER_FREE
+
+	// Free of memory which was already freed
+	FAULT_DOUBLE_FREE
+
+	// Misaligned access or jump
+	FAULT_MISALIGNED
+
+	// Undecodable or unsupported instruction
+	FAULT_ILLEGAL_INSTRUCTION
+
+	// Access to the null guard page
+	FAULT_NULL_DEREF
+
+	// Overwrite of stack guard or return state
+	FAULT_STACK_CORRUPTION
+
+	// Integer division by zero, when trapping on it is enabled
+	FAULT_DIV_BY_ZERO
+
+	// Write to executable memory, when `detect_code_write` is enabled
+	FAULT_CODE_WRITE
+
+	// Guest allocation which couldn't be satisfied, or was over `max_alloc`
+	FAULT_OOM
+
+	// An error which isn't any of the faults above
+	FAULT_UNKNOWN
+)
+
+// Name of each FaultKind, indexed by its value
+var fault_kind_names = []string{
+	FAULT_NONE:                "none",
+	FAULT_READ_OOB:            "OOB read",
+	FAULT_WRITE_OOB:           "OOB write",
+	FAULT_UNINIT_READ:         "uninitialized read",
+	FAULT_PERM_DENIED:         "permission denied",
+	FAULT_USE_AFTER_FREE:      "use after free",
+	FAULT_DOUBLE_FREE:         "double free",
+	FAULT_MISALIGNED:          "misaligned access",
+	FAULT_ILLEGAL_INSTRUCTION: "illegal instruction",
+	FAULT_NULL_DEREF:          "null dereference",
+	FAULT_STACK_CORRUPTION:    "stack corruption",
+	FAULT_DIV_BY_ZERO:         "division by zero",
+	FAULT_CODE_WRITE:          "code write",
+	FAULT_OOM:                 "out of memory",
+	FAULT_UNKNOWN:             "unknown",
+}
+
+func (k FaultKind) String() string {
+	if int(k) < len(fault_kind_names) {
+		return fault_kind_names[k]
+	}
+	return fmt.Sprintf("FaultKind(%d)", uint8(k))
+}
+
+// Classify an error returned (or panicked) by a guest memory access
+func fault_kind(err error) FaultKind {
+	var perm_fault *PermFault
+	switch {
+	case err == nil:
+		return FAULT_NONE
+	case errors.Is(err, ErrNullDeref):
+		return FAULT_NULL_DEREF
+	case errors.Is(err, ErrReadOOB):
+		return FAULT_READ_OOB
+	case errors.Is(err, ErrWriteOOB):
+		return FAULT_WRITE_OOB
+	case errors.Is(err, ErrCodeWrite):
+		return FAULT_CODE_WRITE
+	case errors.As(err, &perm_fault):
+		// Reading memory which is only waiting to be written is an
+		// uninitialized read rather than a plain permission problem
+		if !perm_fault.write && perm_fault.has.uint8&PERM_RAW != 0 {
+			return FAULT_UNINIT_READ
+		}
+		return FAULT_PERM_DENIED
+	case errors.Is(err, ErrAllocOOM), errors.Is(err, ErrAllocTooLarge):
+		return FAULT_OOM
+	}
+
+	// Never report a failure as FAULT_NONE, or a caller checking for it
+	// would treat the failure as success
+	return FAULT_UNKNOWN
+}
+
 // A permission byte which corresponds to a memory byte in the guest
 // address space and defines the permissions it has
 type Perm struct {
 	uint8
 }
 
+// Render the permission bits as e.g. "R|W", or "none" if no bits are set
+func (p Perm) String() string {
+	names := []string{}
+	if p.uint8&PERM_READ != 0 {
+		names = append(names, "R")
+	}
+	if p.uint8&PERM_WRITE != 0 {
+		names = append(names, "W")
+	}
+	if p.uint8&PERM_EXEC != 0 {
+		names = append(names, "X")
+	}
+	if p.uint8&PERM_RAW != 0 {
+		names = append(names, "RAW")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// Describes a guest read or write which was denied because a byte in the
+// accessed range was missing a required permission
+type PermFault struct {
+	// Address and size of the whole access
+	access VirtAddr
+	size   uint
+
+	// Address of the first byte which was missing the permission
+	addr VirtAddr
+
+	// Permissions the offending byte has
+	has Perm
+
+	// Permissions the access needed
+	needs Perm
+
+	// Whether the access was a write (otherwise it was a read)
+	write bool
+
+	// Name of the region the offending byte is in, if it has one
+	region string
+
+	// If the offending byte is unmapped (has no permissions at all), the
+	// nearest byte within NEAREST_MAPPED_WINDOW which is mapped and the
+	// distance from it to the offending byte. The distance is positive if
+	// the offending byte is past the mapped byte, so a small positive
+	// distance is a short overrun off the end of some mapping.
+	nearest     VirtAddr
+	distance    int64
+	has_nearest bool
+}
+
+// Whether the access started in memory with the required permission and ran
+// into memory without it. This usually means a buffer overflow.
+func (f *PermFault) crosses_boundary() bool {
+	return f.addr.addr != f.access.addr
+}
+
+// Explain the fault, e.g. "write to 0x11200 denied: has R, needs W (page
+// 0x11000)", or for an access which crossed into memory without the
+// permission, "read of 8 bytes from 0x11200 crosses permission boundary at
+// 0x11204: has none, needs R (page 0x11000, 1 bytes from mapped 0x11203)"
+func (f *PermFault) Error() string {
+	verb, dir := "read", "from"
+	if f.write {
+		verb, dir = "write", "to"
+	}
+	where := fmt.Sprintf("%#x", f.addr.addr)
+	if f.region != "" {
+		where += " in [" + f.region + "]"
+	}
+	context := fmt.Sprintf(" (page %#x)", f.addr.addr&^(PAGE_SIZE-1))
+	if f.has_nearest {
+		context = fmt.Sprintf(
+			" (page %#x, %d bytes from mapped %#x)", f.addr.addr&^(PAGE_SIZE-1), f.distance, f.nearest.addr,
+		)
+	}
+	if f.crosses_boundary() {
+		return fmt.Sprintf(
+			"%s of %d bytes %s %#x crosses permission boundary at %s: has %s, needs %s%s",
+			verb, f.size, dir, f.access.addr, where, f.has, f.needs, context,
+		)
+	}
+	return fmt.Sprintf("%s %s %s denied: has %s, needs %s%s", verb, dir, where, f.has, f.needs, context)
+}
+
+// Lets `errors.Is` match a PermFault against ErrReadDenied/ErrWriteDenied
+func (f *PermFault) Unwrap() error {
+	if f.write {
+		return ErrWriteDenied
+	}
+	return ErrReadDenied
+}
+
+// Describes a guest read or write which runs past the end of the guest
+// address space
+type OobFault struct {
+	// Address and size of the access
+	addr VirtAddr
+	size uint
+
+	// Size of the guest address space at the time of the access
+	mem_size uint
+
+	// Whether the access was a write (otherwise it was a read)
+	write bool
+}
+
+// Explain the fault, e.g. "read of 8 bytes from 0x1fffc (page 0x1f000) is
+// outside the 0x20000 byte guest address space"
+func (f *OobFault) Error() string {
+	verb, dir := "read", "from"
+	if f.write {
+		verb, dir = "write", "to"
+	}
+	return fmt.Sprintf(
+		"%s of %d bytes %s %#x (page %#x) is outside the %#x byte guest address space",
+		verb, f.size, dir, f.addr.addr, f.addr.addr&^(PAGE_SIZE-1), f.mem_size,
+	)
+}
+
+// Lets `errors.Is` match an OobFault against ErrReadOOB/ErrWriteOOB
+func (f *OobFault) Unwrap() error {
+	if f.write {
+		return ErrWriteOOB
+	}
+	return ErrReadOOB
+}
+
 // Holds a guest virtual address
 type VirtAddr struct {
 	addr uint
 }
 
+// A named range of guest memory, used to label addresses in debug output
+type Region struct {
+	base VirtAddr
+	size uint
+	name string
+}
+
+// Latency histogram for one kind of MMU operation
+type OpStats struct {
+	// Number of operations and the total time they took
+	count uint64
+	total time.Duration
+
+	// buckets[i] counts operations which took less than 2^i nanoseconds
+	// (and at least 2^(i-1)). The last bucket also holds anything slower
+	buckets [40]uint64
+}
+
+// Record an operation which started at `start`
+func (s *OpStats) record_since(start time.Time) {
+	elapsed := time.Since(start)
+	s.count++
+	s.total += elapsed
+
+	bucket := 0
+	for ns := uint64(elapsed); ns != 0 && bucket < len(s.buckets)-1; ns >>= 1 {
+		bucket++
+	}
+	s.buckets[bucket]++
+}
+
+// Add the counts from `other` into these stats
+func (s *OpStats) merge(other *OpStats) {
+	s.count += other.count
+	s.total += other.total
+	for i, n := range other.buckets {
+		s.buckets[i] += n
+	}
+}
+
+// Latency instrumentation for the main MMU operations
+type MmuStats struct {
+	read_into  OpStats
+	write_from OpStats
+	reset      OpStats
+	fork       OpStats
+}
+
+// Fresh stats for a fork of an MMU with stats `s`, or nil if `s` is nil
+func (s *MmuStats) fork_stats() *MmuStats {
+	if s == nil {
+		return nil
+	}
+	return &MmuStats{}
+}
+
+// Add the counts from `other` into these stats. `other` must no longer be
+// in use by its MMU
+func (s *MmuStats) merge(other *MmuStats) {
+	s.read_into.merge(&other.read_into)
+	s.write_from.merge(&other.write_from)
+	s.reset.merge(&other.reset)
+	s.fork.merge(&other.fork)
+}
+
+// Write a summary of each operation's count, mean and latency histogram
+func (s *MmuStats) report(w io.Writer) {
+	ops := []struct {
+		name  string
+		stats *OpStats
+	}{
+		{"read_into", &s.read_into}, {"write_from", &s.write_from}, {"reset", &s.reset}, {"fork", &s.fork},
+	}
+	for _, op := range ops {
+		mean := time.Duration(0)
+		if op.stats.count != 0 {
+			mean = op.stats.total / time.Duration(op.stats.count)
+		}
+		fmt.Fprintf(w, "%-10s count %d total %v mean %v\n", op.name, op.stats.count, op.stats.total, mean)
+		for i, n := range op.stats.buckets {
+			if n == 0 {
+				continue
+			}
+
+			// The last bucket has no upper bound
+			if i == len(op.stats.buckets)-1 {
+				fmt.Fprintf(w, "%-10s   ≥ %v: %d\n", "", time.Duration(1)<<uint(i-1), n)
+			} else {
+				fmt.Fprintf(w, "%-10s   < %v: %d\n", "", time.Duration(1)<<uint(i), n)
+			}
+		}
+	}
+}
+
 // Defines the structure of the MMU for a given emulator instance.
 // This is an isolated memory space to be used by the emulator to load files
 // and provide memory allocations to the underlying program the emulator is
@@ -49,6 +418,52 @@ type Mmu struct {
 
 	// Current base address of the next allocation
 	cur_alc VirtAddr
+
+	// Accesses to addresses below this are reported as null dereferences
+	// rather than ordinary permission faults. 0 disables the guard
+	null_guard uint
+
+	// Largest size a single allocation may request. 0 means no cap
+	max_alloc uint
+
+	// Number of forks between this MMU and the root MMU it descends from.
+	// The root MMU is generation 0
+	generation uint
+
+	// The MMU this one was forked from, nil for the root MMU. This is the
+	// baseline a `reset` would normally be expected to restore to
+	parent *Mmu
+
+	// Set once this MMU has been forked
+	forked bool
+
+	// Size the backing memory may grow to when an allocation doesn't fit.
+	// 0 (or anything not above the current size) disables growth
+	max_size uint
+
+	// Sort the dirty list by address before restoring it in `reset`, so the
+	// restore walks memory linearly and in a predictable order
+	sort_dirty bool
+
+	// Report writes to bytes with PERM_EXEC set as `ErrCodeWrite`, even if
+	// they are also writable, since overwriting code is a strong sign of an
+	// exploitable bug
+	detect_code_write bool
+
+	// Named regions of memory, such as the stack. Only looked up when
+	// reporting, so accesses never touch this
+	named_regions []Region
+
+	// Number of times this MMU has been reset, and how many of those resets
+	// had nothing dirty to restore. A high clean count suggests inputs are
+	// faulting before they reach any interesting code
+	resets       uint
+	clean_resets uint
+
+	// Latency instrumentation, nil when disabled. Each fork gets its own
+	// stats, so forks running on separate goroutines never write to the same
+	// counters. Combine them with `merge` to report a whole run
+	stats *MmuStats
 }
 
 // Create a new instance of the MMU struct with of size `size`
@@ -63,9 +478,52 @@ func newMmu(size uint) *Mmu {
 	return &m
 }
 
+// Mmu: Return a pointer to the guest memory byte at index `i`. In debug builds
+// the index is checked first so an MMU bug reports which operation went wrong,
+// rather than Go's generic index out of range panic. `op` names the caller.
+func (m *Mmu) at(i uint, op string) *uint8 {
+	if MMU_DEBUG && i >= uint(len(m.memory)) {
+		panic(fmt.Sprintf(
+			"MMU bug in %s: index %#x is outside the %#x byte guest memory", op, i, len(m.memory),
+		))
+	}
+	return &m.memory[i]
+}
+
+// Mmu: Return the guest memory bytes from `start` up to `end`, checked in
+// debug builds the same way as `at`. For operations which work on a whole
+// range at once, such as the builtin `copy`.
+func (m *Mmu) span(start, end uint, op string) []uint8 {
+	if MMU_DEBUG && (start > end || end > uint(len(m.memory))) {
+		panic(fmt.Sprintf(
+			"MMU bug in %s: range %#x-%#x is outside the %#x byte guest memory", op, start, end, len(m.memory),
+		))
+	}
+	return m.memory[start:end]
+}
+
+// Mmu: Translate a host pointer into the guest memory backing store (such as
+// the `phy:` addresses in debug output) back to its guest address. Returns
+// false if `p` doesn't point into this MMU's memory.
+func (m *Mmu) host_to_guest(p *uint8) (VirtAddr, bool) {
+	if p == nil || len(m.memory) == 0 {
+		return VirtAddr{}, false
+	}
+
+	base := uintptr(unsafe.Pointer(&m.memory[0]))
+	ptr := uintptr(unsafe.Pointer(p))
+	if ptr < base || ptr-base >= uintptr(len(m.memory)) {
+		return VirtAddr{}, false
+	}
+	return VirtAddr{addr: uint(ptr - base)}, true
+}
+
 // Mmu: Fork an existing MMU instance, copying over the parent MMU's memory
 // and permissions.
 func (m *Mmu) fork() *Mmu {
+	if m.stats != nil {
+		defer m.stats.fork.record_since(time.Now())
+	}
 	fmt.Println("\n===== FORKING =======")
 	size := uint(len(m.memory))
 	clone := Mmu{
@@ -74,63 +532,221 @@ func (m *Mmu) fork() *Mmu {
 		dirty:        make([]VirtAddr, 0, (size/DIRTY_BLOCK_SIZE)+1),
 		dirty_bitmap: make([]uint, ((size/DIRTY_BLOCK_SIZE)/64)+1),
 		cur_alc:      VirtAddr{addr: m.cur_alc.addr},
+		null_guard:   m.null_guard,
+		max_alloc:    m.max_alloc,
+		sort_dirty:   m.sort_dirty,
+		generation:   m.generation + 1,
+		parent:       m,
+
+		detect_code_write: m.detect_code_write,
+		named_regions:     append([]Region(nil), m.named_regions...),
+		stats:             m.stats.fork_stats(),
 	}
 
+	// Parent and child must stay the same size for `reset` to work, so
+	// neither may grow from here on
+	m.forked = true
+
 	// Copy the parent MMU's current memory and permissions to the clone
 	copy(clone.memory, m.memory)
 	copy(clone.permissions, m.permissions)
 	return &clone
 }
 
-// Mmm: Set permission `perm` for `size` bytes starting at `addr`
+// Mmu: Treat the first `size` bytes of the guest address space as a null guard.
+// Any read or write starting in this range faults with `ErrNullDeref`.
+func (m *Mmu) set_null_guard(size uint) {
+	if size > m.cur_alc.addr {
+		panic("null guard would overlap allocated memory")
+	}
+	m.null_guard = size
+}
+
+// Mmu: Label `size` bytes starting at `addr` as `name` in debug output and
+// fault reports. Later names take precedence where regions overlap.
+func (m *Mmu) name_region(addr VirtAddr, size uint, name string) {
+	m.named_regions = append(m.named_regions, Region{base: addr, size: size, name: name})
+}
+
+// Mmu: Return the name of the region containing `addr`, or "" if it isn't in
+// a named region
+func (m *Mmu) region_name(addr VirtAddr) string {
+	for i := len(m.named_regions) - 1; i >= 0; i-- {
+		region := m.named_regions[i]
+		if addr.addr >= region.base.addr && addr.addr-region.base.addr < region.size {
+			return region.name
+		}
+	}
+	return ""
+}
+
+// Mmu: Return the named regions, in the order they were named
+func (m *Mmu) regions() []Region {
+	return append([]Region(nil), m.named_regions...)
+}
+
+// Mmu: Print the named regions and the permissions at the start of each
+func (m *Mmu) print_maps() {
+	caller := currentFunc()
+	for _, region := range m.named_regions {
+		perm := Perm{0}
+		if region.base.addr < uint(len(m.permissions)) {
+			perm = m.permissions[region.base.addr]
+		}
+		fmt.Printf(
+			"[%s]: vma:%#x-%#x %-8s [%s]\n", caller, region.base.addr, region.base.addr+region.size, perm, region.name,
+		)
+	}
+}
+
+// Mmm: Set permission `perm` for `size` bytes starting at `addr`. The blocks
+// are marked dirty so a `reset` restores the permissions they had before
 func (m *Mmu) set_permission(addr VirtAddr, size uint, perm Perm) {
 	// Check if the permission change would go OOB
 	if addr.addr+size > uint(len(m.memory)) {
-		panic("Request would set permissions OOB of guest address space")
+		panic(fmt.Sprintf(
+			"Request would set permissions OOB of guest address space: vma:%#x size %#x, guest size %#x",
+			addr.addr, size, len(m.memory),
+		))
 	}
 
 	// Apply permission `perm` to `size` bytes starting at `addr`
 	for i := addr.addr; i < addr.addr+size; i++ {
 		m.permissions[i] = perm
 	}
+	m.mark_dirty(addr, size)
 }
 
-// Mmu: Restore memory to the state provided in `orig_mmu` (clears dirty blocks)
-func (m *Mmu) reset(orig_mmu *Mmu) {
-	fmt.Println("\n===== RESETTING FORK =======")
+// Mmu: Check that `orig_mmu` can be used as a baseline to reset this MMU to.
+// Only this MMU's dirty blocks are restored, so it must be the MMU this one
+// was forked from. A grandparent, or an unrelated MMU of the same size, can
+// differ in blocks this MMU never dirtied.
+func (m *Mmu) check_baseline(orig_mmu *Mmu) error {
+	if orig_mmu != m.parent {
+		return ErrNotParent
+	}
+	if len(orig_mmu.memory) != len(m.memory) || len(orig_mmu.permissions) != len(m.permissions) {
+		return fmt.Errorf(
+			"can't reset a %#x byte MMU to a %#x byte baseline", len(m.memory), len(orig_mmu.memory),
+		)
+	}
+	return nil
+}
+
+// Mmu: Copy the memory and/or permissions of every dirty block back from
+// `orig_mmu`. The dirty list is left as is.
+func (m *Mmu) restore_dirty(orig_mmu *Mmu, memory bool, permissions bool) {
+	if m.sort_dirty {
+		sort.Slice(m.dirty, func(i, j int) bool { return m.dirty[i].addr < m.dirty[j].addr })
+	}
 	for _, block := range m.dirty {
 		// Get the start and end (virtual) addresses of the dirtied blocks of memory
-		start := block.addr
-		end := block.addr + DIRTY_BLOCK_SIZE
-
-		// Zero the bitmap. `block.addr` was previously multiplied back up by DIRTY_BLOCK_SIZE, so we divide
-		// back down for the bitmap indexing
-		bm_idx := (block.addr / DIRTY_BLOCK_SIZE) / 64
-		m.dirty_bitmap[bm_idx] = 0
+		start, end := m.block_range(block)
 
 		// Restore memory state and permissions from the state of the `orig_mmu`
-		for idx := start; idx <= end; idx++ {
-			m.memory[idx] = orig_mmu.memory[idx]
-			m.permissions[idx] = orig_mmu.permissions[idx]
+		if memory {
+			for idx := start; idx < end; idx++ {
+				*m.at(idx, "reset") = orig_mmu.memory[idx]
+			}
 		}
+		// Permissions aren't behind `at`, but `block_range` clamps to the end
+		// of memory and `check_baseline` ensured both MMUs are the same size
+		if permissions {
+			copy(m.permissions[start:end], orig_mmu.permissions[start:end])
+		}
+	}
+}
+
+// Mmu: Restore the contents of dirty memory to the state in `orig_mmu`,
+// leaving permissions alone. The blocks stay dirty, since their permissions
+// may still differ from the baseline.
+func (m *Mmu) reset_memory(orig_mmu *Mmu) error {
+	if err := m.check_baseline(orig_mmu); err != nil {
+		return err
+	}
+	m.restore_dirty(orig_mmu, true, false)
+	return nil
+}
+
+// Mmu: Restore the permissions of dirty memory to the state in `orig_mmu`,
+// undoing RaW promotions and permission changes but leaving the contents
+// alone. The blocks stay dirty, since their contents may still differ from
+// the baseline.
+func (m *Mmu) reset_permissions(orig_mmu *Mmu) error {
+	if err := m.check_baseline(orig_mmu); err != nil {
+		return err
+	}
+	m.restore_dirty(orig_mmu, false, true)
+	return nil
+}
+
+// Mmu: Restore memory to the state provided in `orig_mmu` (clears dirty blocks)
+func (m *Mmu) reset(orig_mmu *Mmu) error {
+	if m.stats != nil {
+		defer m.stats.reset.record_since(time.Now())
+	}
+	fmt.Println("\n===== RESETTING FORK =======")
+	if err := m.check_baseline(orig_mmu); err != nil {
+		return err
+	}
+
+	// Fast path: nothing was written since the last reset
+	m.resets++
+	if len(m.dirty) == 0 {
+		m.clean_resets++
+		return nil
+	}
+
+	m.restore_dirty(orig_mmu, true, true)
+
+	// Zero the bitmap. `block.addr` was previously multiplied back up by DIRTY_BLOCK_SIZE, so we divide
+	// back down for the bitmap indexing
+	for _, block := range m.dirty {
+		m.dirty_bitmap[(block.addr/DIRTY_BLOCK_SIZE)/64] = 0
 	}
 
 	// Clear the dirty block list
 	// NOTE: KEEPS THE ALLOCATED MEMORY, INDEXING BACK INTO THE LIST WILL FIND THESE VALUES
 	m.dirty = m.dirty[:0]
+	return nil
 }
 
-// Mmu: allocate a region of memory as RW in the guest address space
+// Mmu: allocate a region of memory as RW in the guest address space, panicking
+// if the allocation can't be satisfied
 func (m *Mmu) allocate(size uint) VirtAddr {
+	base, err := m.try_allocate(size)
+	if err != nil {
+		panic(fmt.Errorf("allocate of %#x bytes at vma:%#x: %w", size, m.cur_alc.addr, err))
+	}
+	return base
+}
+
+// Mmu: allocate a region of memory as RW in the guest address space, returning
+// an error if the allocation is over the `max_alloc` cap or doesn't fit
+func (m *Mmu) try_allocate(size uint) (VirtAddr, error) {
+	// Reject allocations over the per-allocation cap before doing any math
+	// on the size, so huge requests can't wrap around
+	if m.max_alloc != 0 && size > m.max_alloc {
+		return VirtAddr{}, ErrAllocTooLarge
+	}
+
 	// 16-byte align the allocation size
 	align_size := (size + 0xf) &^ 0xf
 
 	// Get the current allocation base addr
 	base := m.cur_alc
 
-	// Check if the last allocation went beyond the guest address space
-	if base.addr+align_size >= uint(len(m.memory)) {
-		panic("allocation would go beyond the guest address space")
+	// Check if the last allocation went beyond the guest address space, and
+	// try to grow the address space to fit it if so. `cur_alc` starts at
+	// 0x10000 so it can already be past the end of a small MMU, which has to
+	// be checked first so the subtraction can't wrap around
+	if align_size < size || align_size >= ^uint(0)-base.addr {
+		return VirtAddr{}, ErrAllocOOM
+	}
+	if base.addr > uint(len(m.memory)) || align_size >= uint(len(m.memory))-base.addr {
+		if err := m.grow_to_fit(base.addr + align_size + 1); err != nil {
+			return VirtAddr{}, err
+		}
 	}
 
 	// Update the cur_alc, adding the size of the new allocation
@@ -144,38 +760,238 @@ func (m *Mmu) allocate(size uint) VirtAddr {
 		"[%s]: setting PERM_RAW|PERM_WRITE for %d bytes at: vma:%#x (phy:%p)\n", currentFunc(), size, base.addr, &m.memory[base.addr],
 	)
 	m.set_permission(base, size, Perm{PERM_RAW | PERM_WRITE})
-	return base
+	return base, nil
+}
+
+// Guest accesses are gated by permissions alone: a byte can be read if it has
+// PERM_READ and written if it has PERM_WRITE, regardless of where it sits
+// relative to `cur_alc`. Memory which was never allocated or mapped has no
+// permissions, so accesses past the allocation high-water mark still fault,
+// but as permission faults which name the offending byte.
+
+// Mmu: Build the PermFault for an access of `size` bytes at `access` which
+// failed at the byte `bad`
+func (m *Mmu) perm_fault(access VirtAddr, size uint, bad VirtAddr, needs Perm, write bool) *PermFault {
+	fault := &PermFault{
+		access: access,
+		size:   size,
+		addr:   bad,
+		has:    m.permissions[bad.addr],
+		needs:  needs,
+		write:  write,
+		region: m.region_name(bad),
+	}
+	if fault.has.uint8 == 0 {
+		if nearest, found := m.nearest_mapped(bad); found {
+			fault.nearest = nearest
+			fault.distance = int64(bad.addr) - int64(nearest.addr)
+			fault.has_nearest = true
+		}
+	}
+	return fault
+}
+
+// Mmu: Find the closest byte to `addr` which has any permission set, looking
+// no further than NEAREST_MAPPED_WINDOW either side. The search works outwards
+// from `addr`, so it is cheap for addresses just off the edge of a mapping, and
+// bounded so a wild pointer into a large MMU doesn't scan all of memory on
+// every fault. Ties go to the byte below `addr`.
+func (m *Mmu) nearest_mapped(addr VirtAddr) (VirtAddr, bool) {
+	size := uint(len(m.permissions))
+	for dist := uint(0); dist <= NEAREST_MAPPED_WINDOW; dist++ {
+		if dist <= addr.addr && addr.addr-dist < size && m.permissions[addr.addr-dist].uint8 != 0 {
+			return VirtAddr{addr: addr.addr - dist}, true
+		}
+		if addr.addr+dist < size && m.permissions[addr.addr+dist].uint8 != 0 {
+			return VirtAddr{addr: addr.addr + dist}, true
+		}
+	}
+	return VirtAddr{}, false
+}
+
+// Mmu: Check that `size` bytes starting at `addr` can be written, without
+// modifying any memory
+func (m *Mmu) check_write(addr VirtAddr, size uint) error {
+	// Zero-size accesses touch no memory, so they always succeed
+	if size == 0 {
+		return nil
+	}
+
+	// Check if the write lands in the null guard
+	if addr.addr < m.null_guard {
+		return ErrNullDeref
+	}
+
+	// Check if the write operation would go OOB, without letting
+	// `addr.addr+size` wrap around
+	if addr.addr > uint(len(m.memory)) || size > uint(len(m.memory))-addr.addr {
+		return &OobFault{addr: addr, size: size, mem_size: uint(len(m.memory)), write: true}
+	}
+
+	// Check for the write perm bit on each byte
+	needs := Perm{PERM_WRITE}
+	if bad, found := m.first_missing_perm(addr, size, needs); found {
+		return m.perm_fault(addr, size, bad, needs, true)
+	}
+
+	// Check for writes into code, if enabled
+	if m.detect_code_write {
+		for i, v := range m.permissions[addr.addr : addr.addr+size] {
+			if (v.uint8 & PERM_EXEC) != 0 {
+				return fmt.Errorf("write to %#x: %w", addr.addr+uint(i), ErrCodeWrite)
+			}
+		}
+	}
+	return nil
+}
+
+// Mmu: Mark the blocks spanned by `size` bytes starting at `addr` as dirty
+func (m *Mmu) mark_dirty(addr VirtAddr, size uint) {
+	if size == 0 {
+		return
+	}
+
+	// Compute the blocks for dirtied bits. We divide the start address and the address of the
+	// last byte by the dirty block size to break them down into blocks.
+	var block_start uint = (addr.addr / DIRTY_BLOCK_SIZE)
+	var block_end uint = (addr.addr + size - 1) / DIRTY_BLOCK_SIZE
+	var block_size uint = block_end - block_start + 1
+	fmt.Printf("[%s]: block_start = %d | block_end = %d | block_size = %d\n", currentFunc(), block_start, block_end, block_size)
+
+	// Update dirty list and the bitmap with each block found
+	for i := block_start; i <= block_end; i++ {
+		m.mark_block_dirty(i)
+	}
+}
+
+// Mmu: Mark the block with index `block` as dirty, if it isn't already
+func (m *Mmu) mark_block_dirty(block uint) {
+	// Determine the bitmap position of the dirty block
+	idx := block / 64
+	bit := block % 64
+
+	// If the value at dirty_bitmap[idx] is 0, this hasn't been marked as dirty yet
+	if m.dirty_bitmap[idx]&(1<<bit) == 0 {
+		// Add it to the dirty list. The list is created with room for every
+		// block, so this should never reallocate. Debug builds check that.
+		old_cap := cap(m.dirty)
+		m.dirty = append(m.dirty, VirtAddr{addr: block * DIRTY_BLOCK_SIZE})
+		if MMU_DEBUG && cap(m.dirty) != old_cap {
+			panic(fmt.Sprintf(
+				"MMU bug in mark_block_dirty: dirty list grew from cap %d to %d", old_cap, cap(m.dirty),
+			))
+		}
+
+		// Update the dirty bitmap for this block
+		m.dirty_bitmap[idx] |= 1 << bit
+		fmt.Printf("[%s]: added block to dirty list and updated bitmap\n", currentFunc())
+	}
+}
+
+// Mmu: Mark any PERM_RAW bytes in the `size` bytes starting at `addr` as
+// readable, now that they have been written to
+func (m *Mmu) update_raw(addr VirtAddr, size uint) {
+	for i := uint(0); i < size; i++ {
+		if (m.permissions[addr.addr+i].uint8 & PERM_RAW) != 0 {
+			m.permissions[addr.addr+i] = Perm{m.permissions[addr.addr+i].uint8 | PERM_READ}
+		}
+	}
+}
+
+// Mmu: Allocate a `size` byte RW buffer with REDZONE_SIZE bytes of
+// no-permission red zone directly before and after it, so an access even one
+// byte outside the buffer faults. The buffer is named `name` and the red zones
+// "`name` redzone" in fault reports. Intended for buffers such as the fuzz
+// input, where overflows would otherwise land in other valid memory.
+func (m *Mmu) allocate_redzoned(size uint, name string) VirtAddr {
+	// Allocate the red zones and buffer as one chunk, then take the
+	// permissions away from everything but the buffer
+	chunk := m.allocate(REDZONE_SIZE + size + REDZONE_SIZE)
+	m.set_permission(chunk, REDZONE_SIZE+size+REDZONE_SIZE, Perm{0})
+
+	buf := VirtAddr{addr: chunk.addr + REDZONE_SIZE}
+	m.set_permission(buf, size, Perm{PERM_RAW | PERM_WRITE})
+
+	m.name_region(chunk, REDZONE_SIZE, name+" redzone")
+	m.name_region(buf, size, name)
+	m.name_region(VirtAddr{addr: buf.addr + size}, REDZONE_SIZE, name+" redzone")
+	return buf
+}
+
+// Mmu: Grow the guest address space to at least `needed` bytes, doubling the
+// current size up to `max_size`
+func (m *Mmu) grow_to_fit(needed uint) error {
+	if needed < m.cur_alc.addr || needed > m.max_size {
+		return ErrAllocOOM
+	}
+
+	new_size := uint(len(m.memory))
+	if new_size == 0 {
+		new_size = needed
+	}
+	for new_size < needed {
+		new_size *= 2
+	}
+	if new_size > m.max_size {
+		new_size = m.max_size
+	}
+	return m.grow(new_size)
+}
+
+// Mmu: Grow the guest address space to `new_size` bytes. Existing memory,
+// permissions and dirty state are preserved and the new space has no
+// permissions. Forked MMUs can't grow, since `reset` relies on parent and
+// child being the same size.
+func (m *Mmu) grow(new_size uint) error {
+	if m.parent != nil || m.forked {
+		return ErrGrowAfterFork
+	}
+	if new_size > m.max_size {
+		return ErrAllocOOM
+	}
+
+	size := uint(len(m.memory))
+	if new_size <= size {
+		return nil
+	}
+	fmt.Printf("[%s]: growing guest addr space from %#x to %#x bytes\n", currentFunc(), size, new_size)
+
+	m.memory = append(m.memory, make([]uint8, new_size-size)...)
+	m.permissions = append(m.permissions, make([]Perm, new_size-size)...)
+
+	// Keep the dirty list big enough for every block so it never has to
+	// grow while dirtying memory
+	dirty := make([]VirtAddr, len(m.dirty), (new_size/DIRTY_BLOCK_SIZE)+1)
+	copy(dirty, m.dirty)
+	m.dirty = dirty
 
+	dirty_bitmap := make([]uint, ((new_size/DIRTY_BLOCK_SIZE)/64)+1)
+	copy(dirty_bitmap, m.dirty_bitmap)
+	m.dirty_bitmap = dirty_bitmap
+	return nil
 }
 
 // Mmu: Write bytes from `buf` to `addr`
 func (m *Mmu) write_from(addr VirtAddr, buf []uint8, size uint) {
-	// Check if the write operation would go OOB
-	if addr.addr+size > uint(len(m.memory)) {
-		panic("Operation would write OOB of guest address space")
+	if m.stats != nil {
+		defer m.stats.write_from.record_since(time.Now())
 	}
 
-	// Check if the read operation would go OOB of the current allocation
-	if addr.addr+size > uint(m.cur_alc.addr) {
-		panic("Operation would write beyond it's allocation")
+	// Check bounds and permissions for the write
+	if err := m.check_write(addr, size); err != nil {
+		panic(fmt.Errorf("write_from vma:%#x size %d: %w", addr.addr, size, err))
 	}
 
 	// Check if the read operation would go OOB of buf
 	if size > uint(len(buf)) {
-		panic("bytes to write from buffer is greater than size of buffer")
+		panic(fmt.Sprintf(
+			"bytes to write from buffer is greater than size of buffer: size %d, buffer %d", size, len(buf),
+		))
 	}
 
-	// Check permissions
-	has_raw := 0
-	for _, v := range m.permissions[addr.addr : addr.addr+size] {
-		// check for RAW perm on each byte
-		if (v.uint8 & PERM_RAW) != 0 {
-			has_raw |= 1
-		}
-		// check for write perm bit on each byte
-		if (v.uint8 & PERM_WRITE) == 0 {
-			panic("Write permission denied")
-		}
+	// Nothing to write, and nothing to mark dirty
+	if size == 0 {
+		return
 	}
 
 	// Write bytes from `buf` to `addr`
@@ -183,82 +999,292 @@ func (m *Mmu) write_from(addr VirtAddr, buf []uint8, size uint) {
 		"[%s]: writing %d bytes to vma:%#x (phy:%p)\n", currentFunc(), len(buf), addr.addr, &m.memory[addr.addr],
 	)
 	for i := uint(0); i < size; i++ {
-		m.memory[addr.addr+i] = buf[i]
+		*m.at(addr.addr+i, "write_from") = buf[i]
 	}
 	fmt.Printf("[%s]: wrote: %v\n", currentFunc(), buf[:size])
 
-	// Compute the blocks for dirtied bits. We divide the start address and end address by the
-	// dirty block size to break them down into blocks.
-	var block_start uint = (addr.addr / DIRTY_BLOCK_SIZE)
-	var block_end uint = (addr.addr + size) / DIRTY_BLOCK_SIZE
-	var block_size uint = block_end - block_start
-	if block_size == 0 {
-		block_size += 1
+	// Track the dirtied blocks and update RaW bits
+	m.mark_dirty(addr, size)
+	m.update_raw(addr, size)
+}
+
+// Mmu: Copy `size` bytes from `src` to `dst` within the guest address space.
+// The source must be readable and the destination writable. Overlapping
+// regions are handled like `memmove`.
+func (m *Mmu) mem_copy(dst, src VirtAddr, size uint) error {
+	if err := m.check_read(src, size); err != nil {
+		return fmt.Errorf("mem_copy src vma:%#x: %w", src.addr, err)
+	}
+	if err := m.check_write(dst, size); err != nil {
+		return fmt.Errorf("mem_copy dst vma:%#x: %w", dst.addr, err)
+	}
+	if size == 0 {
+		return nil
 	}
-	fmt.Printf("[%s]: block_start = %d | block_end = %d | block_size = %d\n", currentFunc(), block_start, block_end, block_size)
 
-	// Update dirty list and the bitmap with each block found
-	for i := block_start; i <= block_end; i++ {
-		// Determine the bitmap position of the dirty block
-		idx := i / 64
-		bit := i % 64
+	// The builtin copy handles overlapping slices correctly
+	fmt.Printf("[%s]: copying %d bytes from vma:%#x to vma:%#x\n", currentFunc(), size, src.addr, dst.addr)
+	copy(m.span(dst.addr, dst.addr+size, "mem_copy"), m.span(src.addr, src.addr+size, "mem_copy"))
 
-		// If the value at dirty_bitmap[idx] is 0, this hasn't been marked as dirty yet
-		if m.dirty_bitmap[idx]&(1<<bit) == 0 {
-			// Add it to the dirty list
-			m.dirty = append(m.dirty, VirtAddr{addr: i * DIRTY_BLOCK_SIZE})
+	m.mark_dirty(dst, size)
+	m.update_raw(dst, size)
+	return nil
+}
 
-			// Update the dirty bitmap for this block
-			m.dirty_bitmap[idx] |= 1 << bit
-			fmt.Printf("[%s]: added block to dirty list and updated bitmap\n", currentFunc())
-		}
+// Mmu: Fill `size` bytes starting at `addr` with `val`, like `memset`. The
+// range is permission checked once and its dirty blocks are marked in one go,
+// which is much cheaper than the equivalent loop of single byte writes.
+func (m *Mmu) mem_set(addr VirtAddr, val uint8, size uint) error {
+	if err := m.check_write(addr, size); err != nil {
+		return fmt.Errorf("mem_set vma:%#x size %d: %w", addr.addr, size, err)
+	}
+	if size == 0 {
+		return nil
 	}
 
-	// Update RaW bits
-	if has_raw == 1 {
-		for i := uint(0); i < size; i++ {
-			if (m.permissions[addr.addr+i].uint8 & PERM_RAW) != 0 {
-				// Mark memory as readable now that it's been written to
-				m.permissions[addr.addr+i] = Perm{m.permissions[addr.addr+i].uint8 | PERM_READ}
-			}
+	fmt.Printf("[%s]: setting %d bytes at vma:%#x to %#x\n", currentFunc(), size, addr.addr, val)
+	region := m.span(addr.addr, addr.addr+size, "mem_set")
+	for i := range region {
+		region[i] = val
+	}
+
+	m.mark_dirty(addr, size)
+	m.update_raw(addr, size)
+	return nil
+}
+
+// A single write of `data` to the guest address `addr`, used by `write_batch`
+type WriteOp struct {
+	addr VirtAddr
+	data []uint8
+}
+
+// Mmu: Perform all writes in `ops`. Every op is checked before any memory is
+// modified, so if any op would fail none of them are applied.
+func (m *Mmu) write_batch(ops []WriteOp) error {
+	// Check all of the writes up front
+	for i, op := range ops {
+		if err := m.check_write(op.addr, uint(len(op.data))); err != nil {
+			return fmt.Errorf("write_batch op %d (vma:%#x): %w", i, op.addr.addr, err)
 		}
 	}
 
+	// Everything checks out, apply the writes in order
+	for _, op := range ops {
+		m.write_from(op.addr, op.data, uint(len(op.data)))
+	}
+	return nil
+}
+
+// Mmu: Check that `size` bytes starting at `addr` can be read
+func (m *Mmu) check_read(addr VirtAddr, size uint) error {
+	// Zero-size accesses touch no memory, so they always succeed
+	if size == 0 {
+		return nil
+	}
+
+	// Check if the read lands in the null guard
+	if addr.addr < m.null_guard {
+		return ErrNullDeref
+	}
+
+	// Check if the read operation would go OOB, without letting
+	// `addr.addr+size` wrap around
+	if addr.addr > uint(len(m.memory)) || size > uint(len(m.memory))-addr.addr {
+		return &OobFault{addr: addr, size: size, mem_size: uint(len(m.memory))}
+	}
+
+	// Check for the read perm bit on each byte
+	needs := Perm{PERM_READ}
+	if bad, found := m.first_missing_perm(addr, size, needs); found {
+		return m.perm_fault(addr, size, bad, needs, false)
+	}
+	return nil
+}
+
+// Mmu: Find the first byte in the `size` bytes starting at `addr` which is
+// missing any of the bits in `perm`. Bytes outside the guest address space
+// count as missing. Returns false if the whole range has the permission.
+func (m *Mmu) first_missing_perm(addr VirtAddr, size uint, perm Perm) (VirtAddr, bool) {
+	for i := uint(0); i < size; i++ {
+		cur := addr.addr + i
+		if cur < addr.addr || cur >= uint(len(m.memory)) {
+			return VirtAddr{addr: cur}, true
+		}
+		if m.permissions[cur].uint8&perm.uint8 != perm.uint8 {
+			return VirtAddr{addr: cur}, true
+		}
+	}
+	return VirtAddr{}, false
 }
 
 // Mmu: Read bytes from `addr` into `buf`
 func (m *Mmu) read_into(addr VirtAddr, buf []uint8, size uint) {
-	// Check if the read operation would go OOB
-	if addr.addr+size > uint(len(m.memory)) {
-		panic("Operation would read OOB of guest address space")
+	if m.stats != nil {
+		defer m.stats.read_into.record_since(time.Now())
 	}
 
-	// Check if the read operation would go OOB of the current allocation
-	if addr.addr+size > uint(m.cur_alc.addr) {
-		panic("Operation would read beyond the currently allocated space")
+	// Check bounds and permissions for the read
+	if err := m.check_read(addr, size); err != nil {
+		panic(fmt.Errorf("read_into vma:%#x size %d: %w", addr.addr, size, err))
 	}
 
 	// Check if the read operation would go OOB of the out_buf
 	if size > uint(len(buf)) {
-		panic("bytes to read from addr is greater than size of dst buffer")
+		panic(fmt.Sprintf(
+			"bytes to read from addr is greater than size of dst buffer: size %d, buffer %d", size, len(buf),
+		))
 	}
 
-	// Check permissions
-	for _, v := range m.permissions[addr.addr : addr.addr+size] {
-		// check for read perm bit on each byte, return error if any don't have it set
-		if !((v.uint8 & PERM_READ) != 0) {
-			panic("Read permission denied")
-		}
+	// Nothing to read
+	if size == 0 {
+		return
 	}
 
 	// Read bytes from `addr` to `buf`
 	fmt.Printf("[%s]: reading %d bytes from vma:%#x (phy:%p)\n", currentFunc(), len(buf), addr.addr, &m.memory[addr.addr])
 	for i := uint(0); i < size; i++ {
-		buf[i] = m.memory[addr.addr+i]
+		buf[i] = *m.at(addr.addr+i, "read_into")
 	}
 	fmt.Printf("[%s]: read %v\n", currentFunc(), buf)
 }
 
+// Mmu: Return the range of guest memory covered by the dirty block starting
+// at `block`, clamped to the end of the address space
+func (m *Mmu) block_range(block VirtAddr) (uint, uint) {
+	end := block.addr + DIRTY_BLOCK_SIZE
+	if end > uint(len(m.memory)) {
+		end = uint(len(m.memory))
+	}
+	return block.addr, end
+}
+
+// Mmu: Encode the dirty blocks of this MMU as a delta against the baseline it
+// was forked from. Only the dirty block indices and their memory and
+// permission bytes are written, so this is much smaller than a full snapshot.
+//
+// The format is little-endian: the memory size, `cur_alc` and the number of
+// blocks as u64s, then for each block its u64 index followed by the block's
+// memory bytes and permission bytes.
+func (m *Mmu) encode_dirty(w io.Writer) error {
+	header := []uint64{uint64(len(m.memory)), uint64(m.cur_alc.addr), uint64(len(m.dirty))}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("writing delta header: %w", err)
+	}
+
+	perms := make([]uint8, DIRTY_BLOCK_SIZE)
+	for _, block := range m.dirty {
+		start, end := m.block_range(block)
+		if err := binary.Write(w, binary.LittleEndian, uint64(block.addr/DIRTY_BLOCK_SIZE)); err != nil {
+			return fmt.Errorf("writing delta block index: %w", err)
+		}
+		if _, err := w.Write(m.memory[start:end]); err != nil {
+			return fmt.Errorf("writing delta block memory: %w", err)
+		}
+		for i, p := range m.permissions[start:end] {
+			perms[i] = p.uint8
+		}
+		if _, err := w.Write(perms[:end-start]); err != nil {
+			return fmt.Errorf("writing delta block permissions: %w", err)
+		}
+	}
+	return nil
+}
+
+// Mmu: Apply a delta produced by `encode_dirty` to this MMU, which should be
+// (a fork of) the baseline the delta was encoded against. The applied blocks
+// are marked dirty so a later `reset` undoes them.
+func (m *Mmu) apply_dirty(r io.Reader) error {
+	header := make([]uint64, 3)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return fmt.Errorf("reading delta header: %w", err)
+	}
+	if header[0] != uint64(len(m.memory)) {
+		return fmt.Errorf("delta is for a %#x byte MMU, this one is %#x bytes", header[0], len(m.memory))
+	}
+	if header[1] > header[0] {
+		return fmt.Errorf("delta cur_alc %#x is beyond the guest address space", header[1])
+	}
+
+	perms := make([]uint8, DIRTY_BLOCK_SIZE)
+	for i := uint64(0); i < header[2]; i++ {
+		var idx uint64
+		if err := binary.Read(r, binary.LittleEndian, &idx); err != nil {
+			return fmt.Errorf("reading delta block %d index: %w", i, err)
+		}
+		if idx >= (header[0]+uint64(DIRTY_BLOCK_SIZE)-1)/uint64(DIRTY_BLOCK_SIZE) {
+			return fmt.Errorf("delta block %d index %d is beyond the guest address space", i, idx)
+		}
+
+		// Mark the block dirty before reading into it, so a truncated delta
+		// which only partly overwrote it is still undone by `reset`
+		start, end := m.block_range(VirtAddr{addr: uint(idx) * DIRTY_BLOCK_SIZE})
+		m.mark_block_dirty(uint(idx))
+		if _, err := io.ReadFull(r, m.memory[start:end]); err != nil {
+			return fmt.Errorf("reading delta block %d memory: %w", i, err)
+		}
+		if _, err := io.ReadFull(r, perms[:end-start]); err != nil {
+			return fmt.Errorf("reading delta block %d permissions: %w", i, err)
+		}
+		for j, p := range perms[:end-start] {
+			m.permissions[start+uint(j)] = Perm{p}
+		}
+	}
+
+	m.cur_alc = VirtAddr{addr: uint(header[1])}
+	return nil
+}
+
+// Mmu: Read as many bytes as possible from `addr` into `buf`, stopping at the
+// first byte which can't be read. Returns the number of bytes read, and the
+// fault for the first unreadable byte if the whole of `buf` couldn't be filled.
+func (m *Mmu) read_partial(addr VirtAddr, buf []uint8) (uint, error) {
+	size := uint(len(buf))
+	if size == 0 {
+		return 0, nil
+	}
+
+	// Find how many bytes are readable before the first fault
+	n := uint(0)
+	var err error
+	for ; n < size; n++ {
+		if err = m.check_read(VirtAddr{addr: addr.addr + n}, 1); err != nil {
+			break
+		}
+	}
+
+	fmt.Printf("[%s]: read %d of %d bytes from vma:%#x\n", currentFunc(), n, size, addr.addr)
+
+	// Nothing was readable, so `addr` may not even be inside guest memory
+	if n == 0 {
+		return 0, err
+	}
+	copy(buf, m.span(addr.addr, addr.addr+n, "read_partial"))
+	return n, err
+}
+
+// Mmu: Hash the entire guest memory and permissions. This is slow, but two
+// MMUs with the same hash have the same contents regardless of how they got
+// there, which makes it useful for checking that fork and reset are exact.
+func (m *Mmu) full_mem_hash() uint64 {
+	h := fnv.New64a()
+	h.Write(m.memory)
+
+	// Hash the permissions in chunks rather than a byte at a time
+	perms := make([]uint8, DIRTY_BLOCK_SIZE)
+	for start := 0; start < len(m.permissions); start += len(perms) {
+		chunk := perms
+		if len(m.permissions)-start < len(chunk) {
+			chunk = chunk[:len(m.permissions)-start]
+		}
+		for i := range chunk {
+			chunk[i] = m.permissions[start+i].uint8
+		}
+		h.Write(chunk)
+	}
+	return h.Sum64()
+}
+
 // Print the status of the dirty list and dirty_bitmap
 func (m *Mmu) dirty_status() {
 	caller := currentFunc()
@@ -273,11 +1299,57 @@ func (m *Mmu) dirty_status() {
 	}
 }
 
+// Render the byte at `addr` in `m` as hex, or "??" if it isn't readable
+func hexdump_byte(m *Mmu, addr uint) string {
+	if addr >= uint(len(m.memory)) || m.permissions[addr].uint8&PERM_READ == 0 {
+		return "??"
+	}
+	return fmt.Sprintf("%02x", m.memory[addr])
+}
+
+// Render a hex diff of `size` bytes starting at `addr` in `a` and `b`, 16
+// bytes per line. Lines that match are printed once, lines that differ are
+// printed from `a` (prefixed with "-") then `b` (prefixed with "+"), followed
+// by a line with "^^" under each differing byte. Bytes that aren't readable
+// are shown as "??".
+func hexdump_diff(a, b *Mmu, addr VirtAddr, size uint) string {
+	var out strings.Builder
+	for line := uint(0); line < size; line += 16 {
+		line_a := []string{}
+		line_b := []string{}
+		marks := []string{}
+		differs := false
+		for i := line; i < line+16 && i < size; i++ {
+			byte_a := hexdump_byte(a, addr.addr+i)
+			byte_b := hexdump_byte(b, addr.addr+i)
+			line_a = append(line_a, byte_a)
+			line_b = append(line_b, byte_b)
+			if byte_a != byte_b {
+				marks = append(marks, "^^")
+				differs = true
+			} else {
+				marks = append(marks, "  ")
+			}
+		}
+
+		if !differs {
+			fmt.Fprintf(&out, "  %#08x: %s\n", addr.addr+line, strings.Join(line_a, " "))
+			continue
+		}
+		fmt.Fprintf(&out, "- %#08x: %s\n", addr.addr+line, strings.Join(line_a, " "))
+		fmt.Fprintf(&out, "+ %#08x: %s\n", addr.addr+line, strings.Join(line_b, " "))
+		fmt.Fprintf(&out, "  %10s  %s\n", "", strings.TrimRight(strings.Join(marks, " "), " "))
+	}
+	return out.String()
+}
 
 // A struct that represents the emulated system
 type Emulator struct {
 	// Memory space of the emulator
 	memory Mmu
+
+	// The emulator this one was forked from, nil for the root emulator
+	parent *Emulator
 }
 
 // Create a new Emulator instance
@@ -291,10 +1363,39 @@ func newEmu(size uint) *Emulator {
 // Create a fork of the emulator
 func (e *Emulator) fork() *Emulator {
 	m := e.memory.fork()
-	forked := Emulator{memory: *m}
+	forked := Emulator{memory: *m, parent: e}
 	return &forked
 }
 
+// Return the fork generation of the emulator (0 for the root emulator)
+func (e *Emulator) generation() uint {
+	return e.memory.generation
+}
+
+// Allocate a `size` byte stack for the guest with a guard region below it,
+// or a DEFAULT_STACK_SIZE one if `size` is 0. The guard has no permissions, so
+// running off the bottom of the stack faults straight away instead of
+// corrupting whatever was allocated before it. Returns the address of the top
+// of the stack, aligned down to 16 bytes as the RISC-V ABI requires of `sp`.
+func (e *Emulator) setup_stack(size uint) VirtAddr {
+	if size == 0 {
+		size = DEFAULT_STACK_SIZE
+	}
+
+	// Allocate the guard first so it sits directly below the stack, and take
+	// away the permissions `allocate` gave it
+	guard := e.memory.allocate(STACK_GUARD_SIZE)
+	e.memory.set_permission(guard, STACK_GUARD_SIZE, Perm{0})
+
+	// The stack grows down from the end of its allocation
+	stack := e.memory.allocate(size)
+	top := VirtAddr{addr: (stack.addr + size) &^ 0xf}
+	e.memory.name_region(guard, STACK_GUARD_SIZE, "stack guard")
+	e.memory.name_region(stack, size, "stack")
+	fmt.Printf("[%s]: stack at vma:%#x-%#x, guard at vma:%#x\n", currentFunc(), stack.addr, top.addr, guard.addr)
+	return top
+}
+
 // Alloc, write, read
 func (emu *Emulator) alloc_write_read(size uint) {
 	// save the current function identifier
@@ -326,6 +1427,40 @@ func (emu *Emulator) alloc_write_read(size uint) {
 
 }
 
+// Decode the sign-extended immediate of an I-type instruction (inst[31:20])
+func imm_i(inst uint32) int64 {
+	return int64(int32(inst) >> 20)
+}
+
+// Decode the sign-extended immediate of an S-type instruction
+// (imm[11:5] = inst[31:25], imm[4:0] = inst[11:7])
+func imm_s(inst uint32) int64 {
+	imm := (inst>>25)<<5 | (inst>>7)&0x1f
+	return int64(int32(imm<<20) >> 20)
+}
+
+// Decode the sign-extended immediate of a B-type instruction
+// (imm[12] = inst[31], imm[10:5] = inst[30:25], imm[4:1] = inst[11:8],
+// imm[11] = inst[7]). Bit 0 is always 0
+func imm_b(inst uint32) int64 {
+	imm := (inst>>31)<<12 | ((inst>>7)&1)<<11 | ((inst>>25)&0x3f)<<5 | ((inst>>8)&0xf)<<1
+	return int64(int32(imm<<19) >> 19)
+}
+
+// Decode the immediate of a U-type instruction (imm[31:12] = inst[31:12]),
+// sign-extended to 64 bits as RV64 does
+func imm_u(inst uint32) int64 {
+	return int64(int32(inst & 0xfffff000))
+}
+
+// Decode the sign-extended immediate of a J-type instruction
+// (imm[20] = inst[31], imm[10:1] = inst[30:21], imm[11] = inst[20],
+// imm[19:12] = inst[19:12]). Bit 0 is always 0
+func imm_j(inst uint32) int64 {
+	imm := (inst>>31)<<20 | ((inst>>12)&0xff)<<12 | ((inst>>20)&1)<<11 | ((inst>>21)&0x3ff)<<1
+	return int64(int32(imm<<11) >> 11)
+}
+
 // Return the calling function's name
 func currentFunc() string {
 	pc := make([]uintptr, 15)
@@ -369,7 +1504,9 @@ func main() {
 		forked.memory.dirty_status()
 
 		// Reset the forked emulator state back to the original
-		forked.memory.reset(&emu.memory)
+		if err := forked.memory.reset(&emu.memory); err != nil {
+			panic(err)
+		}
 
 		// Read data back from the forked emulator to ensure we've returned back to the state before we forked
 		// This should contain the values we wrote to the allocation before forking (`in_buf`)
@@ -0,0 +1,1243 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Generations count forks from the root and parents point at the direct parent
+func TestForkGeneration(t *testing.T) {
+	root := newEmu(1024 * 1024)
+	child := root.fork()
+	grandchild := child.fork()
+
+	for i, emu := range []*Emulator{root, child, grandchild} {
+		if emu.generation() != uint(i) {
+			t.Errorf("emulator %d: generation %d, want %d", i, emu.generation(), i)
+		}
+	}
+
+	if root.parent != nil || root.memory.parent != nil {
+		t.Errorf("root emulator has a parent")
+	}
+	if child.parent != root || child.memory.parent != &root.memory {
+		t.Errorf("child's parent isn't the root")
+	}
+	if grandchild.parent != child || grandchild.memory.parent != &child.memory {
+		t.Errorf("grandchild's parent isn't the child")
+	}
+}
+
+// A batch with one invalid op applies none of them
+func TestWriteBatchAtomic(t *testing.T) {
+	base := newMmu(1024 * 1024)
+	a := base.allocate(16)
+	b := base.allocate(16)
+	base.set_permission(b, 16, Perm{PERM_READ})
+	m := base.fork()
+	before := append([]uint8(nil), m.memory...)
+
+	err := m.write_batch([]WriteOp{
+		{addr: a, data: []uint8{1, 2, 3, 4}},
+		{addr: b, data: []uint8{5, 6}},
+	})
+	if !errors.Is(err, ErrWriteDenied) {
+		t.Fatalf("write_batch error %v, want ErrWriteDenied", err)
+	}
+	if !bytes.Equal(m.memory, before) {
+		t.Errorf("failed batch modified memory")
+	}
+	if len(m.dirty) != 0 {
+		t.Errorf("failed batch dirtied %d blocks", len(m.dirty))
+	}
+
+	// With the bad op removed the rest of the batch applies
+	if err := m.write_batch([]WriteOp{{addr: a, data: []uint8{1, 2, 3, 4}}}); err != nil {
+		t.Fatalf("write_batch: %v", err)
+	}
+	if !bytes.Equal(m.memory[a.addr:a.addr+4], []uint8{1, 2, 3, 4}) || len(m.dirty) != 1 {
+		t.Errorf("valid batch wasn't applied")
+	}
+}
+
+// Accesses to the null guard are reported distinctly from permission faults
+func TestNullGuard(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	m.set_null_guard(4096)
+
+	err := m.check_read(VirtAddr{addr: 0}, 8)
+	if !errors.Is(err, ErrNullDeref) || fault_kind(err) != FAULT_NULL_DEREF {
+		t.Errorf("load from 0: %v (%s), want null dereference", err, fault_kind(err))
+	}
+	if err := m.check_write(VirtAddr{addr: 0xff8}, 4); !errors.Is(err, ErrNullDeref) {
+		t.Errorf("store into the guard: %v, want ErrNullDeref", err)
+	}
+
+	// Unmapped memory past the guard is an ordinary permission fault
+	err = m.check_read(VirtAddr{addr: 0x1000}, 8)
+	if errors.Is(err, ErrNullDeref) || fault_kind(err) != FAULT_PERM_DENIED {
+		t.Errorf("load from 0x1000: %v (%s), want permission denied", err, fault_kind(err))
+	}
+}
+
+// mem_copy between allocations and within one, in both overlap directions
+func TestMemCopy(t *testing.T) {
+	base := newMmu(1024 * 1024)
+	src := base.allocate(16)
+	base.write_from(src, []uint8{1, 2, 3, 4, 5, 6, 7, 8}, 8)
+	dst := base.allocate(DIRTY_BLOCK_SIZE)
+	m := base.fork()
+
+	if err := m.mem_copy(dst, src, 8); err != nil {
+		t.Fatalf("mem_copy: %v", err)
+	}
+	if !bytes.Equal(m.memory[dst.addr:dst.addr+8], []uint8{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("copy produced %v", m.memory[dst.addr:dst.addr+8])
+	}
+	if m.check_read(dst, 8) != nil || m.check_read(dst, 9) == nil {
+		t.Errorf("copy should make exactly the copied RaW bytes readable")
+	}
+	if len(m.dirty) != 1 || m.dirty[0].addr != dst.addr&^(DIRTY_BLOCK_SIZE-1) {
+		t.Errorf("dirty list %v, want only the destination block", m.dirty)
+	}
+
+	// Overlapping forwards: dst above src
+	if err := m.mem_copy(VirtAddr{addr: dst.addr + 2}, dst, 6); err != nil {
+		t.Fatalf("forward overlapping mem_copy: %v", err)
+	}
+	if !bytes.Equal(m.memory[dst.addr:dst.addr+8], []uint8{1, 2, 1, 2, 3, 4, 5, 6}) {
+		t.Errorf("forward overlap produced %v", m.memory[dst.addr:dst.addr+8])
+	}
+
+	// Overlapping backwards: dst below src
+	if err := m.mem_copy(dst, VirtAddr{addr: dst.addr + 2}, 6); err != nil {
+		t.Fatalf("backward overlapping mem_copy: %v", err)
+	}
+	if !bytes.Equal(m.memory[dst.addr:dst.addr+8], []uint8{1, 2, 3, 4, 5, 6, 5, 6}) {
+		t.Errorf("backward overlap produced %v", m.memory[dst.addr:dst.addr+8])
+	}
+
+	// Unreadable source bytes are rejected
+	if err := m.mem_copy(dst, VirtAddr{addr: src.addr + 8}, 4); !errors.Is(err, ErrReadDenied) {
+		t.Errorf("copy from unwritten memory: %v, want ErrReadDenied", err)
+	}
+}
+
+// Allocations over the cap are rejected, ones under it succeed
+func TestAllocCap(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	m.max_alloc = 0x1000
+
+	if _, err := m.try_allocate(0x1001); !errors.Is(err, ErrAllocTooLarge) {
+		t.Errorf("allocation above the cap: %v, want ErrAllocTooLarge", err)
+	}
+	if _, err := m.try_allocate(^uint(0)); !errors.Is(err, ErrAllocTooLarge) {
+		t.Errorf("huge allocation: %v, want ErrAllocTooLarge", err)
+	}
+	base, err := m.try_allocate(0x1000)
+	if err != nil || base.addr != 0x10000 {
+		t.Errorf("allocation at the cap: %#x, %v", base.addr, err)
+	}
+
+	// Without a cap, running out of address space is ErrAllocOOM
+	m.max_alloc = 0
+	if _, err := m.try_allocate(1024 * 1024); !errors.Is(err, ErrAllocOOM) {
+		t.Errorf("allocation larger than memory: %v, want ErrAllocOOM", err)
+	}
+	if _, err := m.try_allocate(^uint(0) - 0x100); !errors.Is(err, ErrAllocOOM) {
+		t.Errorf("wrapping allocation: %v, want ErrAllocOOM", err)
+	}
+}
+
+// An MMU smaller than the initial cur_alc reports OOM rather than panicking
+func TestAllocSmallMmu(t *testing.T) {
+	m := newMmu(0x1000)
+	if _, err := m.try_allocate(16); !errors.Is(err, ErrAllocOOM) {
+		t.Errorf("allocation in a 0x1000 byte MMU: %v, want ErrAllocOOM", err)
+	}
+}
+
+// The first byte missing a permission is reported exactly
+func TestFirstMissingPerm(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	base := m.allocate(32)
+	m.set_permission(base, 20, Perm{PERM_READ | PERM_WRITE})
+
+	bad, found := m.first_missing_perm(base, 32, Perm{PERM_READ})
+	if !found || bad.addr != base.addr+20 {
+		t.Errorf("first_missing_perm = %#x, %v, want %#x", bad.addr, found, base.addr+20)
+	}
+	if _, found := m.first_missing_perm(base, 20, Perm{PERM_READ}); found {
+		t.Errorf("readable range reported a missing perm")
+	}
+
+	// Needing several bits fails on a byte missing any of them
+	m.set_permission(VirtAddr{base.addr + 5}, 1, Perm{PERM_READ})
+	bad, found = m.first_missing_perm(base, 20, Perm{PERM_READ | PERM_WRITE})
+	if !found || bad.addr != base.addr+5 {
+		t.Errorf("first_missing_perm = %#x, %v, want %#x", bad.addr, found, base.addr+5)
+	}
+
+	// Running off the end of memory reports the first address past it
+	end := VirtAddr{uint(len(m.memory)) - 4}
+	m.set_permission(end, 4, Perm{PERM_READ})
+	bad, found = m.first_missing_perm(end, 8, Perm{PERM_READ})
+	if !found || bad.addr != uint(len(m.memory)) {
+		t.Errorf("first_missing_perm = %#x, %v, want %#x", bad.addr, found, len(m.memory))
+	}
+}
+
+// Applying an encoded delta to a fresh fork reproduces the original fork
+func TestDirtyDeltaRoundTrip(t *testing.T) {
+	base := newMmu(1024 * 1024)
+	a := base.allocate(16)
+	b := base.allocate(0x2000)
+	base.write_from(a, []uint8{1, 2, 3, 4}, 4)
+
+	// Writes, a new allocation that is never written, a redzoned allocation
+	// and a permission-only change on a block nothing writes to
+	src := base.fork()
+	src.write_from(a, []uint8{0xaa, 0xbb}, 2)
+	src.write_from(VirtAddr{b.addr + 0x1ff0}, []uint8{0xcc, 0xdd, 0xee}, 3)
+	src.allocate(0x3000)
+	src.allocate_redzoned(20, "input")
+	src.set_permission(VirtAddr{b.addr + 0x1000}, 16, Perm{PERM_READ})
+
+	var delta bytes.Buffer
+	if err := src.encode_dirty(&delta); err != nil {
+		t.Fatalf("encode_dirty: %v", err)
+	}
+	dst := base.fork()
+	if err := dst.apply_dirty(&delta); err != nil {
+		t.Fatalf("apply_dirty: %v", err)
+	}
+
+	if !bytes.Equal(dst.memory, src.memory) {
+		t.Errorf("memory differs after applying the delta")
+	}
+	for i := range src.permissions {
+		if dst.permissions[i] != src.permissions[i] {
+			t.Fatalf("permissions differ at %#x: %s, want %s", i, dst.permissions[i], src.permissions[i])
+		}
+	}
+	if dst.cur_alc != src.cur_alc {
+		t.Errorf("cur_alc %#x, want %#x", dst.cur_alc.addr, src.cur_alc.addr)
+	}
+	if len(dst.dirty) != len(src.dirty) {
+		t.Errorf("%d dirty blocks, want %d", len(dst.dirty), len(src.dirty))
+	}
+}
+
+// A truncated delta errors, and whatever it did apply is undone by a reset
+func TestDirtyDeltaTruncated(t *testing.T) {
+	base := newMmu(1024 * 1024)
+	src := base.fork()
+	a := src.allocate(16)
+	src.write_from(a, bytes.Repeat([]uint8{0xaa}, 16), 16)
+
+	var delta bytes.Buffer
+	if err := src.encode_dirty(&delta); err != nil {
+		t.Fatalf("encode_dirty: %v", err)
+	}
+	truncated := bytes.NewReader(delta.Bytes()[:delta.Len()-10])
+
+	dst := base.fork()
+	if err := dst.apply_dirty(truncated); err == nil {
+		t.Fatalf("truncated delta applied without an error")
+	}
+	if err := dst.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if !bytes.Equal(dst.memory, base.memory) {
+		t.Errorf("reset didn't undo the truncated delta")
+	}
+	for i := range base.permissions {
+		if dst.permissions[i] != base.permissions[i] {
+			t.Fatalf("permissions differ at %#x after reset", i)
+		}
+	}
+}
+
+// The stack top is 16-byte aligned whatever the size, and 0 uses the default
+func TestSetupStack(t *testing.T) {
+	for _, size := range []uint{100, 0x1000, 0} {
+		emu := newEmu(4 * 1024 * 1024)
+		start := emu.memory.cur_alc.addr
+		top := emu.setup_stack(size)
+		if top.addr&0xf != 0 {
+			t.Errorf("setup_stack(%#x) top %#x isn't 16-byte aligned", size, top.addr)
+		}
+
+		want := size
+		if want == 0 {
+			want = DEFAULT_STACK_SIZE
+		}
+		bottom := start + STACK_GUARD_SIZE
+		if top.addr > bottom+want || top.addr+0x10 <= bottom+want {
+			t.Errorf("setup_stack(%#x) top %#x, want the aligned end of a %#x byte stack at %#x",
+				size, top.addr, want, bottom)
+		}
+		if err := emu.memory.check_write(VirtAddr{top.addr - 8}, 8); err != nil {
+			t.Errorf("setup_stack(%#x): can't write below the top: %v", size, err)
+		}
+	}
+}
+
+// Running off the bottom of the stack faults on the guard
+func TestStackGuard(t *testing.T) {
+	emu := newEmu(4 * 1024 * 1024)
+	top := emu.setup_stack(0x1000)
+	bottom := VirtAddr{top.addr - 0x1000}
+
+	if err := emu.memory.check_write(bottom, 8); err != nil {
+		t.Fatalf("write at the stack bottom: %v", err)
+	}
+	err := emu.memory.check_write(VirtAddr{bottom.addr - 8}, 8)
+	var fault *PermFault
+	if !errors.As(err, &fault) || !errors.Is(err, ErrWriteDenied) {
+		t.Fatalf("write below the stack: %v, want a permission fault", err)
+	}
+	if fault.addr.addr != bottom.addr-8 || fault.has != (Perm{0}) {
+		t.Errorf("fault at %#x with %s, want %#x with no permissions", fault.addr.addr, fault.has, bottom.addr-8)
+	}
+}
+
+// A write to a read-only byte explains what the byte has and what was needed
+func TestPermFaultMessage(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	base := m.allocate(16)
+	m.set_permission(base, 16, Perm{PERM_READ})
+
+	err := m.check_write(VirtAddr{base.addr + 4}, 1)
+	want := fmt.Sprintf("write to %#x denied: has R, needs W (page %#x)", base.addr+4, base.addr&^(PAGE_SIZE-1))
+	if err == nil || err.Error() != want {
+		t.Errorf("check_write error %q, want %q", err, want)
+	}
+
+	// Named regions are included in the message
+	m.name_region(base, 16, "rodata")
+	err = m.check_write(base, 2)
+	want = fmt.Sprintf("write to %#x in [rodata] denied: has R, needs W (page %#x)", base.addr, base.addr&^(PAGE_SIZE-1))
+	if err == nil || err.Error() != want {
+		t.Errorf("check_write error %q, want %q", err, want)
+	}
+}
+
+// Growing keeps existing contents and dirty state, and the new space is usable
+func TestGrow(t *testing.T) {
+	m := newMmu(0x20000)
+	m.max_size = 0x100000
+	a := m.allocate(16)
+	m.write_from(a, []uint8{1, 2, 3, 4}, 4)
+	dirty := append([]VirtAddr(nil), m.dirty...)
+
+	// Allocating past the end of memory grows it
+	b, err := m.try_allocate(0x20000)
+	if err != nil {
+		t.Fatalf("try_allocate past the end of memory: %v", err)
+	}
+	if len(m.memory) <= 0x20000 || len(m.permissions) != len(m.memory) {
+		t.Fatalf("memory is %#x bytes with %#x perms after growing", len(m.memory), len(m.permissions))
+	}
+	buf := make([]uint8, 4)
+	m.read_into(a, buf, 4)
+	if !bytes.Equal(buf, []uint8{1, 2, 3, 4}) {
+		t.Errorf("contents %v after growing, want [1 2 3 4]", buf)
+	}
+	if len(m.dirty) < len(dirty) || m.dirty[0] != dirty[0] {
+		t.Errorf("dirty list %v after growing, want it to start with %v", m.dirty, dirty)
+	}
+	if m.dirty_bitmap[0] == 0 {
+		t.Errorf("dirty bitmap lost after growing")
+	}
+
+	end := VirtAddr{b.addr + 0x20000 - 4}
+	m.write_from(end, []uint8{5, 6, 7, 8}, 4)
+	m.read_into(end, buf, 4)
+	if !bytes.Equal(buf, []uint8{5, 6, 7, 8}) {
+		t.Errorf("grown memory reads back %v, want [5 6 7 8]", buf)
+	}
+
+	// Growing can't go past max_size
+	if _, err := m.try_allocate(0x100000); !errors.Is(err, ErrAllocOOM) {
+		t.Errorf("allocation past max_size: %v, want ErrAllocOOM", err)
+	}
+
+	// Nor can either side of a fork grow, since reset needs them the same size
+	child := m.fork()
+	if err := m.grow(0x100000); !errors.Is(err, ErrGrowAfterFork) {
+		t.Errorf("grow in the parent after fork: %v, want ErrGrowAfterFork", err)
+	}
+	if err := child.grow(0x100000); !errors.Is(err, ErrGrowAfterFork) {
+		t.Errorf("grow in the child: %v, want ErrGrowAfterFork", err)
+	}
+}
+
+// Sorting the dirty list before a reset doesn't change what gets restored
+func TestSortedReset(t *testing.T) {
+	base := newMmu(1024 * 1024)
+	buf := base.allocate(0x10000)
+	base.write_from(buf, bytes.Repeat([]uint8{0x11}, 0x100), 0x100)
+
+	var hashes []uint64
+	for _, sorted := range []bool{false, true} {
+		base.sort_dirty = sorted
+		child := base.fork()
+
+		// Dirty the blocks out of address order
+		for _, off := range []uint{0xf000, 0x3000, 0x8000, 0x0, 0x5000} {
+			child.write_from(VirtAddr{buf.addr + off}, []uint8{0xaa, 0xbb}, 2)
+		}
+		if err := child.reset(base); err != nil {
+			t.Fatalf("reset with sort_dirty=%v: %v", sorted, err)
+		}
+		if !bytes.Equal(child.memory, base.memory) {
+			t.Errorf("reset with sort_dirty=%v didn't restore memory", sorted)
+		}
+		hashes = append(hashes, child.full_mem_hash())
+	}
+	if hashes[0] != hashes[1] || hashes[0] != base.full_mem_hash() {
+		t.Errorf("unsorted hash %#x, sorted %#x, baseline %#x", hashes[0], hashes[1], base.full_mem_hash())
+	}
+}
+
+// Differing bytes are marked under the byte, and unreadable bytes show as "??"
+func TestHexdumpDiff(t *testing.T) {
+	a := newMmu(0x20000)
+	a.set_permission(VirtAddr{0x10000}, 0x20, Perm{PERM_READ})
+	b := a.fork()
+	b.memory[0x10003] = 0x01
+	b.memory[0x10011] = 0x02
+	b.set_permission(VirtAddr{0x1001e}, 2, Perm{PERM_WRITE})
+
+	want := "" +
+		"- 0x00010000: 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00\n" +
+		"+ 0x00010000: 00 00 00 01 00 00 00 00 00 00 00 00 00 00 00 00\n" +
+		"                       ^^\n" +
+		"- 0x00010010: 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00\n" +
+		"+ 0x00010010: 00 02 00 00 00 00 00 00 00 00 00 00 00 00 ?? ??\n" +
+		"                 ^^                                     ^^ ^^\n" +
+		"  0x00010020: ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ?? ??\n"
+	if got := hexdump_diff(a, b, VirtAddr{0x10000}, 0x30); got != want {
+		t.Errorf("hexdump_diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Identical memory has no diff lines, and bytes past the end are "??"
+	want = "  0x0001fff8: 00 00 00 00 00 00 00 00 ?? ?? ?? ?? ?? ?? ?? ??\n"
+	a.set_permission(VirtAddr{0x1fff8}, 8, Perm{PERM_READ})
+	if got := hexdump_diff(a, a, VirtAddr{0x1fff8}, 16); got != want {
+		t.Errorf("hexdump_diff:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// A partial read stops at the first unreadable byte and reports its fault
+func TestReadPartial(t *testing.T) {
+	m := newMmu(0x20000)
+	base := m.allocate(16)
+	m.write_from(base, []uint8{1, 2, 3, 4, 5, 6}, 6)
+	m.set_permission(VirtAddr{base.addr + 4}, 12, Perm{0})
+
+	buf := make([]uint8, 8)
+	n, err := m.read_partial(base, buf)
+	var fault *PermFault
+	if n != 4 || !errors.As(err, &fault) || fault.addr.addr != base.addr+4 {
+		t.Fatalf("read_partial = %d, %v, want 4 and a fault at %#x", n, err, base.addr+4)
+	}
+	if !bytes.Equal(buf, []uint8{1, 2, 3, 4, 0, 0, 0, 0}) {
+		t.Errorf("read_partial read %v", buf)
+	}
+
+	// A fully readable buffer has no error
+	n, err = m.read_partial(base, buf[:4])
+	if n != 4 || err != nil {
+		t.Errorf("read_partial = %d, %v, want 4, nil", n, err)
+	}
+
+	// Starting past the end of memory reads nothing rather than panicking
+	n, err = m.read_partial(VirtAddr{0x30000}, make([]uint8, 4))
+	if n != 0 || !errors.Is(err, ErrReadOOB) {
+		t.Errorf("read_partial past the end = %d, %v, want 0, ErrReadOOB", n, err)
+	}
+	n, err = m.read_partial(VirtAddr{0x1fffe}, make([]uint8, 4))
+	if n != 0 || !errors.Is(err, ErrReadDenied) {
+		t.Errorf("read_partial of unmapped memory = %d, %v, want 0, ErrReadDenied", n, err)
+	}
+}
+
+// With detection on, writes to executable memory are reported as code writes
+func TestCodeWrite(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	m.detect_code_write = true
+	code := m.allocate(32)
+	m.set_permission(code, 32, Perm{PERM_READ | PERM_WRITE | PERM_EXEC})
+	data := m.allocate(32)
+
+	err := m.check_write(VirtAddr{code.addr + 8}, 4)
+	if !errors.Is(err, ErrCodeWrite) || fault_kind(err) != FAULT_CODE_WRITE {
+		t.Errorf("write to RWX memory: %v (%s), want a code write", err, fault_kind(err))
+	}
+	if err := m.check_write(data, 32); err != nil {
+		t.Errorf("write to data: %v", err)
+	}
+
+	// Without detection the RWX write is allowed
+	m.detect_code_write = false
+	if err := m.check_write(VirtAddr{code.addr + 8}, 4); err != nil {
+		t.Errorf("write to RWX memory without detection: %v", err)
+	}
+}
+
+// Memory past `cur_alc` is inside the address space but unmapped, so touching
+// it is a permission fault rather than an out of bounds one
+func TestAccessPastCurAlc(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	base := m.allocate(16)
+	m.set_permission(base, 16, Perm{PERM_READ | PERM_WRITE})
+
+	for _, err := range []error{
+		m.check_read(m.cur_alc, 4),
+		m.check_read(VirtAddr{m.cur_alc.addr - 2}, 4),
+	} {
+		var fault *PermFault
+		if !errors.As(err, &fault) || !errors.Is(err, ErrReadDenied) || errors.Is(err, ErrReadOOB) {
+			t.Errorf("read past cur_alc: %v, want a permission fault", err)
+			continue
+		}
+		if fault.addr != m.cur_alc || fault_kind(err) != FAULT_PERM_DENIED {
+			t.Errorf("fault at %#x (%s), want %#x (%s)", fault.addr.addr, fault_kind(err), m.cur_alc.addr, FAULT_PERM_DENIED)
+		}
+	}
+	if err := m.check_write(m.cur_alc, 1); !errors.Is(err, ErrWriteDenied) {
+		t.Errorf("write past cur_alc: %v, want ErrWriteDenied", err)
+	}
+}
+
+// Host pointers into guest memory translate back to their guest address, and
+// anything else is rejected
+func TestHostToGuest(t *testing.T) {
+	m := newMmu(0x20000)
+	for _, addr := range []uint{0, 0x10000, 0x1ffff} {
+		got, ok := m.host_to_guest(&m.memory[addr])
+		if !ok || got.addr != addr {
+			t.Errorf("host_to_guest(&memory[%#x]) = %#x, %v", addr, got.addr, ok)
+		}
+	}
+
+	other := newMmu(0x20000)
+	if _, ok := m.host_to_guest(nil); ok {
+		t.Errorf("host_to_guest accepted nil")
+	}
+	if _, ok := m.host_to_guest(&other.memory[0x10000]); ok {
+		t.Errorf("host_to_guest accepted a pointer into another MMU")
+	}
+
+	// Back the guest memory with a longer slice so there is a real byte just
+	// past its end
+	backing := make([]uint8, 0x2000)
+	m.memory = backing[:0x1000]
+	if _, ok := m.host_to_guest(&backing[0x1000]); ok {
+		t.Errorf("host_to_guest accepted a pointer one past the end")
+	}
+	if got, ok := m.host_to_guest(&backing[0xfff]); !ok || got.addr != 0xfff {
+		t.Errorf("host_to_guest(&memory[0xfff]) = %#x, %v", got.addr, ok)
+	}
+}
+
+// Each way an MMU access can fail maps to its own FaultKind
+func TestFaultKind(t *testing.T) {
+	m := newMmu(0x20000)
+	m.set_null_guard(0x1000)
+	m.detect_code_write = true
+	fresh := m.allocate(16)
+	ro := m.allocate(16)
+	m.set_permission(ro, 16, Perm{PERM_READ})
+	code := m.allocate(16)
+	m.set_permission(code, 16, Perm{PERM_READ | PERM_WRITE | PERM_EXEC})
+	_, oom := m.try_allocate(0x40000)
+	m.max_alloc = 0x100
+	_, too_large := m.try_allocate(0x101)
+	fork := m.fork()
+
+	tests := []struct {
+		name string
+		err  error
+		want FaultKind
+	}{
+		{"valid read", m.check_read(ro, 16), FAULT_NONE},
+		{"null guard read", m.check_read(VirtAddr{0}, 4), FAULT_NULL_DEREF},
+		{"null guard write", m.check_write(VirtAddr{0x10}, 4), FAULT_NULL_DEREF},
+		{"read OOB", m.check_read(VirtAddr{0x1fffe}, 4), FAULT_READ_OOB},
+		{"write OOB", m.check_write(VirtAddr{0x30000}, 4), FAULT_WRITE_OOB},
+		{"uninitialized read", m.check_read(fresh, 4), FAULT_UNINIT_READ},
+		{"write to read-only", m.check_write(ro, 4), FAULT_PERM_DENIED},
+		{"read of unmapped", m.check_read(m.cur_alc, 4), FAULT_PERM_DENIED},
+		{"code write", m.check_write(code, 4), FAULT_CODE_WRITE},
+		{"wrapped", fmt.Errorf("mem_set: %w", m.check_write(ro, 4)), FAULT_PERM_DENIED},
+		{"allocation OOM", oom, FAULT_OOM},
+		{"allocation too large", too_large, FAULT_OOM},
+		{"grow after fork", fork.grow(0x40000), FAULT_UNKNOWN},
+		{"mismatched baseline", fork.reset(newMmu(0x1000)), FAULT_UNKNOWN},
+		{"other error", errors.New("something else"), FAULT_UNKNOWN},
+	}
+	for _, test := range tests {
+		if got := fault_kind(test.err); got != test.want {
+			t.Errorf("%s: fault_kind(%v) = %s, want %s", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+// The dirty list has room for every block, before and after growing, so
+// dirtying all of memory never reallocates it
+func TestDirtyEveryBlock(t *testing.T) {
+	m := newMmu(0x20800)
+	m.max_size = 0x80000
+
+	dirty_all := func() {
+		old_cap := cap(m.dirty)
+		m.mark_dirty(VirtAddr{0}, uint(len(m.memory)))
+		blocks := (uint(len(m.memory)) + DIRTY_BLOCK_SIZE - 1) / DIRTY_BLOCK_SIZE
+		if uint(len(m.dirty)) != blocks {
+			t.Errorf("%#x byte MMU: %d dirty blocks, want %d", len(m.memory), len(m.dirty), blocks)
+		}
+		if cap(m.dirty) != old_cap {
+			t.Errorf("%#x byte MMU: dirty list grew from cap %d to %d", len(m.memory), old_cap, cap(m.dirty))
+		}
+	}
+
+	dirty_all()
+	if err := m.grow(0x7f800); err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	dirty_all()
+}
+
+// Zero-size accesses succeed anywhere, even outside memory or in the null
+// guard, and don't dirty anything
+func TestZeroSizeAccess(t *testing.T) {
+	root := newMmu(0x20000)
+	root.set_null_guard(0x1000)
+	base := root.allocate(16)
+	m := root.fork()
+
+	for _, addr := range []VirtAddr{base, m.cur_alc, {0}, {0x20000}, {0x30000}, {^uint(0)}} {
+		if err := m.check_read(addr, 0); err != nil {
+			t.Errorf("zero-size check_read at %#x: %v", addr.addr, err)
+		}
+		if err := m.check_write(addr, 0); err != nil {
+			t.Errorf("zero-size check_write at %#x: %v", addr.addr, err)
+		}
+		m.write_from(addr, nil, 0)
+		m.read_into(addr, nil, 0)
+	}
+	if len(m.dirty) != 0 {
+		t.Errorf("zero-size accesses dirtied %d blocks", len(m.dirty))
+	}
+}
+
+// The allocator hands out the same 16-byte aligned addresses for the same
+// sequence of sizes, and a fork carries on from where its parent got to
+func TestAllocDeterministic(t *testing.T) {
+	sizes := []uint{1, 7, 16, 17, 33, 100, 4095, 3}
+	run := func() []uint {
+		m := newMmu(1024 * 1024)
+		addrs := []uint{}
+		for _, size := range sizes {
+			addrs = append(addrs, m.allocate(size).addr)
+		}
+		return addrs
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("allocation %d of %d bytes at %#x, then %#x", i, sizes[i], first[i], second[i])
+		}
+		if first[i]&0xf != 0 {
+			t.Errorf("allocation %d of %d bytes at %#x isn't 16-byte aligned", i, sizes[i], first[i])
+		}
+		if i > 0 && first[i]-first[i-1] != (sizes[i-1]+0xf)&^0xf {
+			t.Errorf("allocation %d is %#x bytes after the previous one", i, first[i]-first[i-1])
+		}
+	}
+
+	parent := newMmu(1024 * 1024)
+	parent.allocate(17)
+	child := parent.fork()
+	if child.cur_alc != parent.cur_alc {
+		t.Errorf("child cur_alc %#x, parent %#x", child.cur_alc.addr, parent.cur_alc.addr)
+	}
+	if got := child.allocate(8); got != parent.cur_alc {
+		t.Errorf("child allocated at %#x, want the parent's cur_alc %#x", got.addr, parent.cur_alc.addr)
+	}
+}
+
+// Resetting against a baseline of a different size fails without touching
+// anything
+func TestResetMismatchedBaseline(t *testing.T) {
+	base := newMmu(0x20000)
+	m := base.fork()
+	a := m.allocate(16)
+	m.write_from(a, []uint8{1, 2, 3, 4}, 4)
+	memory := append([]uint8(nil), m.memory...)
+	dirty := append([]VirtAddr(nil), m.dirty...)
+
+	if err := m.reset(newMmu(0x10000)); err == nil {
+		t.Fatalf("reset against a smaller baseline succeeded")
+	}
+	if !bytes.Equal(m.memory, memory) {
+		t.Errorf("failed reset changed memory")
+	}
+	if len(m.dirty) != len(dirty) || m.dirty[0] != dirty[0] {
+		t.Errorf("failed reset changed the dirty list to %v, want %v", m.dirty, dirty)
+	}
+	if m.resets != 0 {
+		t.Errorf("failed reset was counted")
+	}
+}
+
+// Only the MMU a fork was made from is a valid baseline. A grandparent would
+// leave the parent's changes in blocks the fork never dirtied
+func TestResetNonParentBaseline(t *testing.T) {
+	root := newMmu(0x20000)
+	a := root.allocate(16)
+	root.write_from(a, []uint8{1}, 1)
+	child := root.fork()
+	child.write_from(a, []uint8{2}, 1)
+	grandchild := child.fork()
+	grandchild.write_from(VirtAddr{a.addr + 8}, []uint8{3}, 1)
+
+	for name, baseline := range map[string]*Mmu{"grandparent": root, "unrelated": newMmu(0x20000)} {
+		memory := append([]uint8(nil), grandchild.memory...)
+		if err := grandchild.reset(baseline); !errors.Is(err, ErrNotParent) {
+			t.Errorf("reset to the %s: %v, want ErrNotParent", name, err)
+		}
+		if err := grandchild.reset_memory(baseline); !errors.Is(err, ErrNotParent) {
+			t.Errorf("reset_memory to the %s: %v, want ErrNotParent", name, err)
+		}
+		if !bytes.Equal(grandchild.memory, memory) || len(grandchild.dirty) != 1 {
+			t.Errorf("failed reset to the %s changed the MMU", name)
+		}
+	}
+
+	if err := grandchild.reset(child); err != nil {
+		t.Fatalf("reset to the parent: %v", err)
+	}
+	if !bytes.Equal(grandchild.memory, child.memory) || grandchild.memory[a.addr] != 2 {
+		t.Errorf("reset to the parent didn't restore its memory")
+	}
+}
+
+// The final block of memory is restored right up to the last byte, including
+// when it is only partly inside memory. Run with `-tags debug` to also check
+// the restore never indexes past the end.
+func TestResetLastBlock(t *testing.T) {
+	for _, size := range []uint{0x20000, 0x20800} {
+		base := newMmu(size)
+		end := VirtAddr{size - 8}
+		base.set_permission(end, 8, Perm{PERM_READ | PERM_WRITE})
+		m := base.fork()
+
+		m.write_from(end, bytes.Repeat([]uint8{0xaa}, 8), 8)
+		if err := m.reset(base); err != nil {
+			t.Fatalf("%#x byte MMU: reset: %v", size, err)
+		}
+		if !bytes.Equal(m.memory, base.memory) {
+			t.Errorf("%#x byte MMU: reset didn't restore the last block", size)
+		}
+	}
+}
+
+// An access that starts readable and runs into unreadable memory reports
+// where it crossed the boundary
+func TestPermFaultCrossesBoundary(t *testing.T) {
+	m := newMmu(0x20000)
+	base := m.allocate(16)
+	m.set_permission(base, 4, Perm{PERM_READ})
+	m.set_permission(VirtAddr{base.addr + 4}, 12, Perm{PERM_WRITE})
+
+	err := m.check_read(base, 8)
+	var fault *PermFault
+	if !errors.As(err, &fault) || !fault.crosses_boundary() {
+		t.Fatalf("check_read: %v, want a fault crossing a boundary", err)
+	}
+	want := fmt.Sprintf(
+		"read of 8 bytes from %#x crosses permission boundary at %#x: has W, needs R (page %#x)",
+		base.addr, base.addr+4, (base.addr+4)&^(PAGE_SIZE-1),
+	)
+	if err.Error() != want {
+		t.Errorf("check_read error %q, want %q", err, want)
+	}
+
+	// Into unmapped memory, the message starts the same way
+	m.set_permission(VirtAddr{base.addr + 12}, 4, Perm{PERM_READ})
+	err = m.check_read(VirtAddr{base.addr + 12}, 8)
+	want = fmt.Sprintf("read of 8 bytes from %#x crosses permission boundary at %#x: has none", base.addr+12, base.addr+16)
+	if err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("check_read error %q, want it to start with %q", err, want)
+	}
+
+	// Starting on the bad byte isn't a crossing
+	if err := m.check_read(VirtAddr{base.addr + 4}, 4); !errors.As(err, &fault) || fault.crosses_boundary() {
+		t.Errorf("check_read from the bad byte: %v", err)
+	}
+}
+
+// Faults in the stack and its guard name the region they hit
+func TestStackRegionNames(t *testing.T) {
+	emu := newEmu(4 * 1024 * 1024)
+	top := emu.setup_stack(0x1000)
+	bottom := top.addr - 0x1000
+
+	err := emu.memory.check_write(VirtAddr{bottom - 8}, 4)
+	if err == nil || !strings.Contains(err.Error(), "in [stack guard]") {
+		t.Errorf("write to the guard: %v, want it to name [stack guard]", err)
+	}
+
+	// Reading the stack before writing it hits the RAW permission
+	err = emu.memory.check_read(VirtAddr{top.addr - 8}, 8)
+	if err == nil || !strings.Contains(err.Error(), "in [stack]") {
+		t.Errorf("uninitialized read of the stack: %v, want it to name [stack]", err)
+	}
+	if name := emu.memory.region_name(VirtAddr{top.addr}); name != "" {
+		t.Errorf("top of the stack is in region %q", name)
+	}
+}
+
+// A run that only reads leaves nothing dirty, so resetting takes the clean
+// fast path
+func TestCleanReset(t *testing.T) {
+	base := newMmu(0x20000)
+	a := base.allocate(16)
+	base.write_from(a, []uint8{1, 2, 3, 4}, 4)
+	m := base.fork()
+
+	buf := make([]uint8, 4)
+	m.read_into(a, buf, 4)
+	if len(m.dirty) != 0 {
+		t.Fatalf("reading dirtied %d blocks", len(m.dirty))
+	}
+	if err := m.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if m.resets != 1 || m.clean_resets != 1 {
+		t.Errorf("resets %d, clean_resets %d after a clean reset, want 1, 1", m.resets, m.clean_resets)
+	}
+
+	// A run that writes isn't clean
+	m.write_from(a, []uint8{9}, 1)
+	if err := m.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if m.resets != 2 || m.clean_resets != 1 {
+		t.Errorf("resets %d, clean_resets %d after a dirty reset, want 2, 1", m.resets, m.clean_resets)
+	}
+}
+
+// Call `f` and return the error it panicked with, or nil if it didn't
+func recover_error(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ = r.(error)
+		}
+	}()
+	f()
+	return nil
+}
+
+// The panicking wrappers include the guest address and keep the underlying
+// error for `errors.Is`
+func TestPanicMessages(t *testing.T) {
+	m := newMmu(0x20000)
+	unmapped := m.cur_alc
+
+	tests := []struct {
+		name string
+		f    func()
+		addr uint
+		want error
+	}{
+		{"write_from", func() { m.write_from(unmapped, []uint8{1}, 1) }, unmapped.addr, ErrWriteDenied},
+		{"read_into", func() { m.read_into(VirtAddr{0x30000}, make([]uint8, 4), 4) }, 0x30000, ErrReadOOB},
+		{"allocate", func() { m.allocate(0x40000) }, unmapped.addr, ErrAllocOOM},
+	}
+	for _, test := range tests {
+		err := recover_error(test.f)
+		if err == nil {
+			t.Errorf("%s didn't panic with an error", test.name)
+			continue
+		}
+		if addr := fmt.Sprintf("vma:%#x", test.addr); !strings.Contains(err.Error(), addr) {
+			t.Errorf("%s panicked with %q, want it to contain %q", test.name, err, addr)
+		}
+		if !errors.Is(err, test.want) {
+			t.Errorf("%s panicked with %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+// Partial resets restore one of memory and permissions and keep the other
+func TestPartialReset(t *testing.T) {
+	base := newMmu(0x20000)
+	a := base.allocate(16)
+	for _, memory := range []bool{true, false} {
+		m := base.fork()
+		m.write_from(a, []uint8{1, 2, 3, 4}, 4)
+		m.set_permission(VirtAddr{a.addr + 8}, 8, Perm{PERM_READ})
+		written := append([]uint8(nil), m.memory...)
+		perms := append([]Perm(nil), m.permissions...)
+
+		reset, kept := m.reset_permissions, "memory"
+		if memory {
+			reset, kept = m.reset_memory, "permissions"
+		}
+		if err := reset(base); err != nil {
+			t.Fatalf("resetting all but %s: %v", kept, err)
+		}
+
+		want_memory, want_perms := base.memory, base.permissions
+		if memory {
+			want_perms = perms
+		} else {
+			want_memory = written
+		}
+		if !bytes.Equal(m.memory, want_memory) {
+			t.Errorf("resetting all but %s: wrong memory", kept)
+		}
+		for i := a.addr; i < a.addr+16; i++ {
+			if m.permissions[i] != want_perms[i] {
+				t.Errorf("resetting all but %s: %#x has %s, want %s", kept, i, m.permissions[i], want_perms[i])
+			}
+		}
+		if len(m.dirty) != 1 {
+			t.Errorf("resetting all but %s: %d dirty blocks, want them kept", kept, len(m.dirty))
+		}
+	}
+}
+
+// Running a byte off either end of a redzoned buffer faults in its redzone
+func TestRedzone(t *testing.T) {
+	m := newMmu(0x20000)
+	buf := m.allocate_redzoned(20, "input")
+
+	if err := m.check_write(buf, 20); err != nil {
+		t.Fatalf("write to the buffer: %v", err)
+	}
+	for _, addr := range []uint{buf.addr + 20, buf.addr - 1} {
+		err := m.check_write(VirtAddr{addr}, 1)
+		want := fmt.Sprintf("write to %#x in [input redzone] denied", addr)
+		if !errors.Is(err, ErrWriteDenied) || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("write to %#x: %v, want it to start with %q", addr, err, want)
+		}
+	}
+
+	// An overflowing write is reported where it crossed into the redzone
+	err := m.check_write(VirtAddr{buf.addr + 16}, 5)
+	var fault *PermFault
+	if !errors.As(err, &fault) || fault.addr.addr != buf.addr+20 || fault.region != "input redzone" {
+		t.Errorf("overflowing write: %v", err)
+	}
+}
+
+// A fork hashes the same as its parent until it's written, and the same
+// again once reset
+func TestFullMemHash(t *testing.T) {
+	base := newMmu(0x20000)
+	a := base.allocate(16)
+	base.write_from(a, []uint8{1, 2, 3, 4}, 4)
+	want := base.full_mem_hash()
+
+	m := base.fork()
+	if got := m.full_mem_hash(); got != want {
+		t.Errorf("fork hash %#x, parent %#x", got, want)
+	}
+	m.write_from(a, []uint8{1, 2, 3, 5}, 4)
+	if got := m.full_mem_hash(); got == want {
+		t.Errorf("hash unchanged by a write")
+	}
+	if err := m.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if got := m.full_mem_hash(); got != want {
+		t.Errorf("hash %#x after reset, parent %#x", got, want)
+	}
+
+	// Permissions are part of the hash too
+	m.set_permission(a, 1, Perm{PERM_READ})
+	if got := m.full_mem_hash(); got == want {
+		t.Errorf("hash unchanged by a permission change")
+	}
+}
+
+// Each instrumented operation is counted once. Forks count into their own
+// stats, which merge into the parent's for a whole-run report
+func TestMmuStats(t *testing.T) {
+	base := newMmu(0x20000)
+	base.stats = &MmuStats{}
+	a := base.allocate(16)
+	base.write_from(a, []uint8{1, 2, 3, 4}, 4)
+
+	m := base.fork()
+	buf := make([]uint8, 4)
+	m.read_into(a, buf, 4)
+	m.read_into(a, buf, 2)
+	m.write_from(a, []uint8{5}, 1)
+	if err := m.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if err := m.reset(base); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+
+	if m.stats == base.stats || m.stats.read_into.count != 2 || base.stats.read_into.count != 0 {
+		t.Fatalf("fork's reads weren't counted in its own stats")
+	}
+	base.stats.merge(m.stats)
+	s := base.stats
+	counts := []struct {
+		name  string
+		stats *OpStats
+		want  uint64
+	}{
+		{"read_into", &s.read_into, 2}, {"write_from", &s.write_from, 2}, {"reset", &s.reset, 2}, {"fork", &s.fork, 1},
+	}
+	for _, c := range counts {
+		if c.stats.count != c.want {
+			t.Errorf("%s count %d, want %d", c.name, c.stats.count, c.want)
+		}
+		total := uint64(0)
+		for _, n := range c.stats.buckets {
+			total += n
+		}
+		if total != c.want {
+			t.Errorf("%s buckets hold %d operations, want %d", c.name, total, c.want)
+		}
+	}
+
+	var out bytes.Buffer
+	s.report(&out)
+	if !strings.Contains(out.String(), "read_into  count 2") {
+		t.Errorf("report missing the read_into count:\n%s", out.String())
+	}
+}
+
+// Forks on separate goroutines each record into their own stats, so there's
+// nothing shared to race on. Run with `-race` to check
+func TestMmuStatsConcurrentForks(t *testing.T) {
+	base := newMmu(0x20000)
+	base.stats = &MmuStats{}
+	a := base.allocate(16)
+
+	forks := []*Mmu{base.fork(), base.fork(), base.fork(), base.fork()}
+	done := make(chan struct{})
+	for _, m := range forks {
+		go func(m *Mmu) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 10; i++ {
+				m.write_from(a, []uint8{uint8(i)}, 1)
+				m.reset(base)
+			}
+		}(m)
+	}
+	for range forks {
+		<-done
+	}
+
+	for _, m := range forks {
+		base.stats.merge(m.stats)
+	}
+	if base.stats.write_from.count != 40 || base.stats.reset.count != 40 || base.stats.fork.count != 4 {
+		t.Errorf("merged counts: %d writes, %d resets, %d forks, want 40, 40, 4",
+			base.stats.write_from.count, base.stats.reset.count, base.stats.fork.count)
+	}
+}
+
+// The last latency bucket is reported as a lower bound, since it also holds
+// operations slower than its nominal range
+func TestMmuStatsLastBucket(t *testing.T) {
+	s := &MmuStats{}
+	s.fork.buckets[len(s.fork.buckets)-1] = 3
+	s.fork.buckets[10] = 1
+
+	var out bytes.Buffer
+	s.report(&out)
+	last := fmt.Sprintf("≥ %v: 3\n", time.Duration(1)<<uint(len(s.fork.buckets)-2))
+	if !strings.Contains(out.String(), last) || !strings.Contains(out.String(), "< 1.024µs: 1\n") {
+		t.Errorf("report:\n%s\nwant it to contain %q", out.String(), last)
+	}
+}
+
+// mem_set fills just the requested range and dirties just the blocks it
+// touches, including when it ends exactly on a block boundary
+func TestMemSet(t *testing.T) {
+	tests := []struct {
+		off, size uint
+		blocks    []uint
+	}{
+		{0x800, 0x800, []uint{0x10000}},
+		{0x0, DIRTY_BLOCK_SIZE, []uint{0x10000}},
+		{0xfff, 2, []uint{0x10000, 0x11000}},
+		{0x800, 0x2000, []uint{0x10000, 0x11000, 0x12000}},
+	}
+	for _, test := range tests {
+		root := newMmu(0x20000)
+		base := root.allocate(0x4000)
+		m := root.fork()
+		addr := VirtAddr{base.addr + test.off}
+		if err := m.mem_set(addr, 0x5a, test.size); err != nil {
+			t.Fatalf("mem_set(%#x, %#x): %v", addr.addr, test.size, err)
+		}
+
+		for i := base.addr; i < base.addr+0x4000; i++ {
+			want := uint8(0)
+			if i >= addr.addr && i < addr.addr+test.size {
+				want = 0x5a
+			}
+			if m.memory[i] != want {
+				t.Fatalf("mem_set(%#x, %#x): byte %#x is %#x, want %#x", addr.addr, test.size, i, m.memory[i], want)
+			}
+		}
+
+		if len(m.dirty) != len(test.blocks) {
+			t.Errorf("mem_set(%#x, %#x): dirty blocks %v, want %#x", addr.addr, test.size, m.dirty, test.blocks)
+			continue
+		}
+		for i, block := range test.blocks {
+			if m.dirty[i].addr != block {
+				t.Errorf("mem_set(%#x, %#x): dirty blocks %v, want %#x", addr.addr, test.size, m.dirty, test.blocks)
+				break
+			}
+		}
+	}
+}
+
+// A fault just past a mapping reports a small positive distance from it, and
+// one far from anything mapped reports no nearest mapping
+func TestNearestMapped(t *testing.T) {
+	m := newMmu(1024 * 1024)
+	buf := m.allocate(20)
+	m.set_permission(buf, 20, Perm{PERM_READ | PERM_WRITE})
+	m.set_permission(VirtAddr{buf.addr + 20}, 12, Perm{0})
+
+	err := m.check_read(VirtAddr{buf.addr + 16}, 8)
+	var fault *PermFault
+	if !errors.As(err, &fault) || !fault.has_nearest {
+		t.Fatalf("overread: %v, want a fault with a nearest mapping", err)
+	}
+	if fault.distance != 1 || fault.nearest.addr != buf.addr+19 {
+		t.Errorf("overread is %d bytes from %#x, want 1 byte from %#x", fault.distance, fault.nearest.addr, buf.addr+19)
+	}
+	want := fmt.Sprintf("(page %#x, 1 bytes from mapped %#x)", (buf.addr+20)&^(PAGE_SIZE-1), buf.addr+19)
+	if !strings.HasSuffix(err.Error(), want) {
+		t.Errorf("overread error %q, want it to end with %q", err, want)
+	}
+
+	// An underread is a negative distance from the start of the mapping
+	m.set_permission(VirtAddr{buf.addr - 8}, 8, Perm{0})
+	if err := m.check_read(VirtAddr{buf.addr - 4}, 1); !errors.As(err, &fault) || fault.distance != -4 {
+		t.Errorf("underread: %v, want a distance of -4", err)
+	}
+
+	// Mapped bytes have no nearest mapping, but the page is still reported
+	m.set_permission(buf, 4, Perm{PERM_RAW | PERM_WRITE})
+	err = m.check_read(buf, 4)
+	if err == nil || !strings.HasSuffix(err.Error(), fmt.Sprintf(" (page %#x)", buf.addr&^(PAGE_SIZE-1))) {
+		t.Errorf("uninitialized read: %v, want it to report the page", err)
+	}
+
+	// Accesses past the end of memory report where they were
+	var oob *OobFault
+	err = m.check_write(VirtAddr{uint(len(m.memory)) - 4}, 8)
+	want = fmt.Sprintf("write of 8 bytes to %#x (page %#x) is outside the %#x byte guest address space",
+		len(m.memory)-4, (len(m.memory)-4)&^int(PAGE_SIZE-1), len(m.memory))
+	if !errors.As(err, &oob) || !errors.Is(err, ErrWriteOOB) || err.Error() != want {
+		t.Errorf("OOB write: %v, want %q", err, want)
+	}
+	if err := m.check_read(VirtAddr{^uint(0)}, 1); !errors.As(err, &oob) || !errors.Is(err, ErrReadOOB) {
+		t.Errorf("OOB read: %v, want an OobFault", err)
+	}
+
+	// Nothing mapped within the window
+	wild := VirtAddr{0x80000}
+	if err := m.check_read(wild, 4); !errors.As(err, &fault) || fault.has_nearest {
+		t.Errorf("wild read: %v, want no nearest mapping", err)
+	}
+	if near, found := m.nearest_mapped(VirtAddr{buf.addr + 19 + NEAREST_MAPPED_WINDOW}); !found || near.addr != buf.addr+19 {
+		t.Errorf("nearest_mapped at the edge of the window = %#x, %v", near.addr, found)
+	}
+	if _, found := m.nearest_mapped(VirtAddr{buf.addr + 20 + NEAREST_MAPPED_WINDOW}); found {
+		t.Errorf("nearest_mapped found a mapping outside the window")
+	}
+}
+
+// Each immediate format decodes to the right signed value, including the
+// largest positive and most negative offsets it can encode
+func TestImmediates(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode func(uint32) int64
+		inst   uint32
+		want   int64
+	}{
+		{"addi x1, x0, -1", imm_i, 0xfff00093, -1},
+		{"addi x1, x0, 2047", imm_i, 0x7ff00093, 2047},
+		{"addi x1, x0, -2048", imm_i, 0x80000093, -2048},
+		{"addi x1, x0, 5", imm_i, 0x00500093, 5},
+
+		{"sw x1, -4(x2)", imm_s, 0xfe112e23, -4},
+		{"sb x0, -2048(x0)", imm_s, 0x80000023, -2048},
+		{"sb x0, 2047(x0)", imm_s, 0x7e000fa3, 2047},
+
+		{"beq x0, x0, -4", imm_b, 0xfe000ee3, -4},
+		{"beq x0, x0, -4096", imm_b, 0x80000063, -4096},
+		{"beq x0, x0, 4094", imm_b, 0x7e000fe3, 4094},
+		{"beq x0, x0, 8", imm_b, 0x00000463, 8},
+
+		{"lui x1, 0xfffff", imm_u, 0xfffff0b7, -4096},
+		{"lui x1, 0x12345", imm_u, 0x123450b7, 0x12345000},
+		{"lui x1, 0x80000", imm_u, 0x800000b7, -2147483648},
+
+		{"jal x0, -4", imm_j, 0xffdff06f, -4},
+		{"jal x0, -1048576", imm_j, 0x8000006f, -1048576},
+		{"jal x0, 1048574", imm_j, 0x7ffff06f, 1048574},
+		{"jal x0, 8", imm_j, 0x0080006f, 8},
+	}
+	for _, test := range tests {
+		if got := test.decode(test.inst); got != test.want {
+			t.Errorf("%s (%#08x): immediate %d, want %d", test.name, test.inst, got, test.want)
+		}
+	}
+}
+
+// Changing only permissions, with no writes, is still undone by a reset
+func TestResetPermissionOnly(t *testing.T) {
+	base := newMmu(0x20000)
+	a := base.allocate(16)
+	base.set_permission(a, 16, Perm{PERM_READ | PERM_WRITE})
+
+	for _, reset := range []string{"reset", "reset_permissions"} {
+		m := base.fork()
+		m.set_permission(a, 16, Perm{0})
+		if len(m.dirty) != 1 {
+			t.Fatalf("set_permission dirtied %d blocks, want 1", len(m.dirty))
+		}
+
+		var err error
+		if reset == "reset" {
+			err = m.reset(base)
+		} else {
+			err = m.reset_permissions(base)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", reset, err)
+		}
+		for i := a.addr; i < a.addr+16; i++ {
+			if m.permissions[i] != base.permissions[i] {
+				t.Fatalf("%s: %#x has %s, want %s", reset, i, m.permissions[i], base.permissions[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !debug
+// +build !debug
+
+package main
+
+// Built without `-tags debug`: internal consistency checks are compiled out
+const MMU_DEBUG = false